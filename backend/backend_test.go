@@ -0,0 +1,550 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testBackend runs the tests that every Backend implementation has to pass.
+// The backend must be empty.
+func testBackend(t *testing.T, backend Backend) {
+	t.Run("PutGet", func(t *testing.T) {
+		data := []byte("chunk data")
+		name := "aa/aabb/aabbcc.bin"
+
+		mustPut(t, backend, name, data)
+
+		got, err := backend.Get(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Get returned %q, want %q", got, data)
+		}
+
+		mustPut(t, backend, name, []byte("replaced"))
+
+		got, err = backend.Get(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != "replaced" {
+			t.Fatalf("Get after replacing returned %q", got)
+		}
+	})
+
+	t.Run("PutEmpty", func(t *testing.T) {
+		mustPut(t, backend, "empty.bin", []byte{})
+
+		got, err := backend.Get("empty.bin")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 0 {
+			t.Fatalf("Get returned %d bytes, want 0", len(got))
+		}
+	})
+
+	t.Run("GetRange", func(t *testing.T) {
+		name := "packs/range.pack"
+		mustPut(t, backend, name, []byte("0123456789"))
+
+		for _, test := range []struct {
+			offset uint64
+			length uint64
+			want   string
+		}{
+			{0, 10, "0123456789"},
+			{0, 1, "0"},
+			{3, 4, "3456"},
+			{9, 1, "9"},
+		} {
+			got, err := backend.GetRange(name, test.offset, test.length)
+
+			if err != nil {
+				t.Fatalf("GetRange(%d, %d): %s", test.offset, test.length, err)
+			}
+
+			if string(got) != test.want {
+				t.Fatalf("GetRange(%d, %d) returned %q, want %q", test.offset, test.length, got, test.want)
+			}
+		}
+
+		for _, test := range []struct {
+			offset uint64
+			length uint64
+		}{
+			{5, 10},
+			{10, 1},
+			{20, 5},
+		} {
+			_, err := backend.GetRange(name, test.offset, test.length)
+
+			if !errors.Is(err, ErrTruncated) {
+				t.Fatalf("GetRange(%d, %d) returned %v, want ErrTruncated", test.offset, test.length, err)
+			}
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		mustPut(t, backend, "stat/file.bin", make([]byte, 1234))
+
+		info, err := backend.Stat("stat/file.bin")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Name != "stat/file.bin" || info.Size != 1234 {
+			t.Fatalf("Stat returned %+v", info)
+		}
+	})
+
+	t.Run("NotExist", func(t *testing.T) {
+		_, err := backend.Get("missing/file.bin")
+
+		if !os.IsNotExist(err) {
+			t.Fatalf("Get returned %v, want an error that satisfies os.IsNotExist", err)
+		}
+
+		_, err = backend.GetRange("missing/file.bin", 0, 1)
+
+		if !os.IsNotExist(err) {
+			t.Fatalf("GetRange returned %v, want an error that satisfies os.IsNotExist", err)
+		}
+
+		_, err = backend.Stat("missing/file.bin")
+
+		if !os.IsNotExist(err) {
+			t.Fatalf("Stat returned %v, want an error that satisfies os.IsNotExist", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		files := map[string]int{
+			"list/a/1.bin":    1,
+			"list/a/b/2.bin":  2,
+			"list/ab/3.bin":   3,
+			"list/top.bin":    4,
+			"listed/nope.bin": 5,
+		}
+
+		for name, size := range files {
+			mustPut(t, backend, name, make([]byte, size))
+		}
+
+		for _, test := range []struct {
+			prefix string
+			want   []string
+		}{
+			{"list", []string{"list/a/1.bin", "list/a/b/2.bin", "list/ab/3.bin", "list/top.bin"}},
+			{"list/a", []string{"list/a/1.bin", "list/a/b/2.bin"}},
+			{"list/a/b", []string{"list/a/b/2.bin"}},
+			{"list/missing", nil},
+			{"missing", nil},
+		} {
+			var got []string
+
+			err := backend.List(test.prefix, func(file FileInfo) error {
+				if file.Size != uint64(files[file.Name]) {
+					t.Errorf("List(%q) returned %s with %d bytes, want %d", test.prefix, file.Name, file.Size, files[file.Name])
+				}
+
+				got = append(got, file.Name)
+				return nil
+			})
+
+			if err != nil {
+				t.Fatalf("List(%q): %s", test.prefix, err)
+			}
+
+			sort.Strings(got)
+
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("List(%q) returned %v, want %v", test.prefix, got, test.want)
+			}
+		}
+
+		stop := errors.New("stop")
+		var calls int
+
+		err := backend.List("list", func(file FileInfo) error {
+			calls++
+			return stop
+		})
+
+		if err != stop || calls != 1 {
+			t.Fatalf("List returned %v after %d calls, want the error of fn after 1 call", err, calls)
+		}
+	})
+
+	t.Run("ListAll", func(t *testing.T) {
+		var names []string
+
+		err := backend.List("", func(file FileInfo) error {
+			names = append(names, file.Name)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+
+		for _, name := range names {
+			if name == "aa/aabb/aabbcc.bin" {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("List(\"\") did not return aa/aabb/aabbcc.bin: %v", names)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		mustPut(t, backend, "delete/file.bin", []byte("x"))
+
+		err := backend.Delete("delete/file.bin")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = backend.Stat("delete/file.bin")
+
+		if !os.IsNotExist(err) {
+			t.Fatalf("Stat after Delete returned %v", err)
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		mustPut(t, backend, "rename/old.bin", []byte("new content"))
+		mustPut(t, backend, "rename/existing/new.bin", []byte("old content"))
+
+		err := backend.Rename("rename/old.bin", "rename/existing/new.bin")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := backend.Get("rename/existing/new.bin")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != "new content" {
+			t.Fatalf("Get after Rename returned %q", got)
+		}
+
+		_, err = backend.Stat("rename/old.bin")
+
+		if !os.IsNotExist(err) {
+			t.Fatalf("Stat of the old name returned %v", err)
+		}
+
+		mustPut(t, backend, "rename/other.bin", []byte("x"))
+
+		err = backend.Rename("rename/other.bin", "rename/new/dir/file.bin")
+
+		if err != nil {
+			t.Fatalf("Rename to a new directory: %s", err)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				// Several goroutines create the same directories.
+				name := fmt.Sprintf("concurrent/%d/file%d.bin", i%4, i)
+				data := bytes.Repeat([]byte{byte(i)}, 1000+i)
+
+				err := backend.Put(name, data)
+
+				if err == nil {
+					var got []byte
+					got, err = backend.Get(name)
+
+					if err == nil && !bytes.Equal(got, data) {
+						err = fmt.Errorf("%s has the wrong content", name)
+					}
+				}
+
+				errs <- err
+			}(i)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func mustPut(t *testing.T, backend Backend, name string, data []byte) {
+	t.Helper()
+
+	err := backend.Put(name, data)
+
+	if err != nil {
+		t.Fatalf("Put(%q): %s", name, err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	testBackend(t, NewLocal(t.TempDir()))
+}
+
+func TestIsPermanent(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		permanent bool
+	}{
+		{errors.New("connection reset"), false},
+		{notExist("open", "missing.bin"), false},
+		{&os.PathError{Op: "open", Path: "chunk.bin", Err: os.ErrPermission}, true},
+		{&os.PathError{Op: "write", Path: "chunk.bin", Err: permanentErrnos[0]}, true},
+		{fmt.Errorf("cannot write: %w", &os.PathError{Op: "write", Path: "chunk.bin", Err: syscall.EINTR}), false},
+		{&StatusError{Method: "PUT", URL: "/chunk.bin", StatusCode: http.StatusForbidden, Status: "403 Forbidden"}, true},
+		{&StatusError{Method: "PUT", URL: "/chunk.bin", StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}, false},
+		{&StatusError{Method: "PUT", URL: "/chunk.bin", StatusCode: http.StatusInsufficientStorage, Status: "507 Insufficient Storage"}, true},
+		{&StatusError{Method: "PUT", URL: "/chunk.bin", StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}, false},
+		{minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}, true},
+		{minio.ErrorResponse{Code: "RequestTimeout", StatusCode: http.StatusBadRequest}, false},
+		{minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}, false},
+		{&sftp.StatusError{Code: sftpNoSpaceOnFilesystem}, true},
+		{&sftp.StatusError{Code: 4}, false},
+	} {
+		if permanent := IsPermanent(test.err); permanent != test.permanent {
+			t.Errorf("IsPermanent(%#v) = %t, want %t", test.err, permanent, test.permanent)
+		}
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	addr := startSFTPServer(t)
+	dir := t.TempDir()
+
+	backend, err := NewSFTP(&url.URL{
+		Scheme: schemeSFTP,
+		User:   url.UserPassword("test", "secret"),
+		Host:   addr,
+		Path:   filepath.ToSlash(dir),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer backend.Close()
+
+	testBackend(t, backend)
+}
+
+// TestS3 runs against the S3-compatible server in $SFA_S3_ENDPOINT, e.g. a
+// local MinIO, and is skipped without it. The objects are stored below a
+// random prefix in the bucket $SFA_S3_TEST_BUCKET (default sfa-test), which is
+// created if needed.
+func TestS3(t *testing.T) {
+	if len(os.Getenv("SFA_S3_ENDPOINT")) == 0 {
+		t.Skip("SFA_S3_ENDPOINT is not set")
+	}
+
+	bucket := os.Getenv("SFA_S3_TEST_BUCKET")
+
+	if len(bucket) == 0 {
+		bucket = "sfa-test"
+	}
+
+	prefix := make([]byte, 8)
+	rand.Read(prefix)
+
+	backend, err := NewS3(&url.URL{
+		Scheme: schemeS3,
+		Host:   bucket,
+		Path:   fmt.Sprintf("/test-%x", prefix),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	exists, err := backend.client.BucketExists(ctx, bucket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists {
+		err = backend.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer backend.List("", func(file FileInfo) error {
+		return backend.Delete(file.Name)
+	})
+
+	testBackend(t, backend)
+}
+
+// startSFTPServer starts an SSH server that serves the local file system over
+// SFTP to the user test with the password secret. It returns the address of
+// the server, whose host key is written to a known hosts file in
+// $SSH_KNOWN_HOSTS.
+func startSFTPServer(t *testing.T) string {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(hostKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "test" && string(password) == "secret" {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("wrong password for %s", conn.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go serveSSH(conn, config)
+		}
+	}()
+
+	addr := listener.Addr().String()
+	home := t.TempDir()
+	knownHosts := filepath.Join(home, "known_hosts")
+	line := knownhosts.Line([]string{addr}, signer.PublicKey())
+
+	err = os.WriteFile(knownHosts, []byte(line+"\n"), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the keys and the agent of the user out of the test.
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	t.Setenv("SSH_KNOWN_HOSTS", knownHosts)
+
+	return addr
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+
+		if err != nil {
+			continue
+		}
+
+		go func(requests <-chan *ssh.Request) {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+
+				if !ok {
+					continue
+				}
+
+				server, err := sftp.NewServer(channel)
+
+				if err != nil {
+					channel.Close()
+					return
+				}
+
+				err = server.Serve()
+
+				if err == io.EOF {
+					server.Close()
+				}
+
+				channel.Close()
+				return
+			}
+		}(requests)
+	}
+}
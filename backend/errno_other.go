@@ -0,0 +1,13 @@
+//go:build !windows
+
+package backend
+
+import "syscall"
+
+// permanentErrnos are the system errors that retrying does not resolve.
+var permanentErrnos = []syscall.Errno{
+	syscall.ENOSPC,
+	syscall.EDQUOT,
+	syscall.EROFS,
+	syscall.ENAMETOOLONG,
+}
@@ -0,0 +1,22 @@
+package backend
+
+import "syscall"
+
+// Windows error codes, see
+// https://learn.microsoft.com/en-us/windows/win32/debug/system-error-codes.
+const (
+	errorHandleDiskFull     syscall.Errno = 39
+	errorWriteProtect       syscall.Errno = 19
+	errorDiskFull           syscall.Errno = 112
+	errorFilenameExcedRange syscall.Errno = 206
+	errorDiskQuotaExceeded  syscall.Errno = 1295
+)
+
+// permanentErrnos are the system errors that retrying does not resolve.
+var permanentErrnos = []syscall.Errno{
+	errorHandleDiskFull,
+	errorWriteProtect,
+	errorDiskFull,
+	errorFilenameExcedRange,
+	errorDiskQuotaExceeded,
+}
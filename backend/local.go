@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// Local stores the archive in a local directory.
+type Local struct {
+	Dir string
+}
+
+// NewLocal returns a backend for the local directory dir.
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+func (local *Local) path(name string) string {
+	return filepath.Join(local.Dir, filepath.FromSlash(name))
+}
+
+// Put writes data to a temporary file first, which is then renamed to name.
+func (local *Local) Put(name string, data []byte) error {
+	destPath := local.path(name)
+	tmpPath := destPath + utils.TmpSuffix
+
+	err := os.MkdirAll(filepath.Dir(destPath), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(tmpPath, data, 0700)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, destPath)
+}
+
+func (local *Local) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(local.path(name))
+}
+
+func (local *Local) GetRange(name string, offset uint64, length uint64) ([]byte, error) {
+	file, err := os.Open(local.path(name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	data := make([]byte, length)
+	_, err = file.ReadAt(data, int64(offset))
+
+	if err == io.EOF {
+		return nil, ErrTruncated
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (local *Local) Stat(name string) (FileInfo, error) {
+	fileInfo, err := os.Stat(local.path(name))
+
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Name: name, Size: uint64(fileInfo.Size())}, nil
+}
+
+func (local *Local) List(prefix string, fn func(file FileInfo) error) error {
+	root := local.path(prefix)
+
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(root, func(fullPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(local.Dir, fullPath)
+
+		if err != nil {
+			return err
+		}
+
+		return fn(FileInfo{Name: filepath.ToSlash(relativePath), Size: uint64(fileInfo.Size())})
+	})
+}
+
+func (local *Local) Delete(name string) error {
+	return os.Remove(local.path(name))
+}
+
+func (local *Local) Rename(oldName string, newName string) error {
+	err := os.MkdirAll(filepath.Dir(local.path(newName)), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(local.path(oldName), local.path(newName))
+}
+
+func (local *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultS3Endpoint = "s3.amazonaws.com"
+
+// S3 stores the archive below a prefix in a bucket of an S3-compatible object
+// store.
+type S3 struct {
+	Bucket string
+	Prefix string
+
+	client *minio.Client
+}
+
+// NewS3 returns a backend for u (s3://bucket/prefix). The endpoint is taken
+// from $SFA_S3_ENDPOINT (e.g. http://localhost:9000 for a local MinIO), it
+// defaults to Amazon S3. The credentials are taken from the AWS or MinIO
+// environment variables or from ~/.aws/credentials.
+func NewS3(u *url.URL) (*S3, error) {
+	endpoint := os.Getenv("SFA_S3_ENDPOINT")
+	secure := true
+
+	if len(endpoint) == 0 {
+		endpoint = defaultS3Endpoint
+	} else if strings.HasPrefix(endpoint, "http://") {
+		endpoint = strings.TrimPrefix(endpoint, "http://")
+		secure = false
+	} else {
+		endpoint = strings.TrimPrefix(endpoint, "https://")
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+	})
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: os.Getenv("AWS_REGION"),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		Bucket: u.Host,
+		Prefix: strings.Trim(u.Path, "/"),
+		client: client,
+	}, nil
+}
+
+func (backend *S3) key(name string) string {
+	return path.Join(backend.Prefix, name)
+}
+
+// Put uploads data as name. Objects are only visible once they were
+// uploaded completely.
+func (backend *S3) Put(name string, data []byte) error {
+	_, err := backend.client.PutObject(context.Background(), backend.Bucket, backend.key(name),
+		bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+
+	return err
+}
+
+func (backend *S3) Get(name string) ([]byte, error) {
+	return backend.get(name, minio.GetObjectOptions{})
+}
+
+func (backend *S3) GetRange(name string, offset uint64, length uint64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	err := opts.SetRange(int64(offset), int64(offset+length-1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := backend.get(name, opts)
+
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "InvalidRange" {
+			return nil, ErrTruncated
+		}
+
+		return nil, err
+	}
+
+	if uint64(len(data)) < length {
+		return nil, ErrTruncated
+	}
+
+	return data, nil
+}
+
+func (backend *S3) get(name string, opts minio.GetObjectOptions) ([]byte, error) {
+	object, err := backend.client.GetObject(context.Background(), backend.Bucket, backend.key(name), opts)
+
+	if err != nil {
+		return nil, backend.convertError("get", name, err)
+	}
+
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+
+	if err != nil {
+		return nil, backend.convertError("get", name, err)
+	}
+
+	return data, nil
+}
+
+func (backend *S3) Stat(name string) (FileInfo, error) {
+	info, err := backend.client.StatObject(context.Background(), backend.Bucket, backend.key(name), minio.StatObjectOptions{})
+
+	if err != nil {
+		return FileInfo{}, backend.convertError("stat", name, err)
+	}
+
+	return FileInfo{Name: name, Size: uint64(info.Size)}, nil
+}
+
+func (backend *S3) List(prefix string, fn func(file FileInfo) error) error {
+	keyPrefix := backend.key(prefix)
+
+	if len(keyPrefix) != 0 {
+		keyPrefix += "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objects := backend.client.ListObjects(ctx, backend.Bucket, minio.ListObjectsOptions{
+		Prefix:    keyPrefix,
+		Recursive: true,
+	})
+
+	for object := range objects {
+		if object.Err != nil {
+			return object.Err
+		}
+
+		name := strings.TrimPrefix(object.Key, backend.Prefix)
+		name = strings.TrimPrefix(name, "/")
+
+		err := fn(FileInfo{Name: name, Size: uint64(object.Size)})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (backend *S3) Delete(name string) error {
+	return backend.client.RemoveObject(context.Background(), backend.Bucket, backend.key(name), minio.RemoveObjectOptions{})
+}
+
+// Rename copies oldName to newName on the server and removes oldName.
+func (backend *S3) Rename(oldName string, newName string) error {
+	_, err := backend.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: backend.Bucket, Object: backend.key(newName)},
+		minio.CopySrcOptions{Bucket: backend.Bucket, Object: backend.key(oldName)})
+
+	if err != nil {
+		return backend.convertError("rename", oldName, err)
+	}
+
+	return backend.client.RemoveObject(context.Background(), backend.Bucket, backend.key(oldName), minio.RemoveObjectOptions{})
+}
+
+func (backend *S3) Close() error {
+	return nil
+}
+
+// convertError returns an error that satisfies os.IsNotExist for missing
+// objects.
+func (backend *S3) convertError(op string, name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return notExist(op, name)
+	}
+
+	return err
+}
+
+// isPermanentS3Error returns true if err is a response that will not change
+// when the request is retried.
+func isPermanentS3Error(err error) bool {
+	response := minio.ToErrorResponse(err)
+
+	if response.Code == "RequestTimeout" {
+		return false
+	}
+
+	return isPermanentStatus(response.StatusCode)
+}
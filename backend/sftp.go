@@ -0,0 +1,324 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const defaultSSHPort = "22"
+
+// identityFiles are the private keys in ~/.ssh that are tried for SFTP
+// connections. Keys with a passphrase are skipped, use an SSH agent for them.
+var identityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// SFTP stores the archive in a directory on an SFTP server.
+type SFTP struct {
+	Dir string
+
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// NewSFTP connects to the SFTP server in u (sftp://user@host:port/path). The
+// host key must be in ~/.ssh/known_hosts or in the file in $SSH_KNOWN_HOSTS.
+// The password in u, the SSH agent and unencrypted keys in ~/.ssh are used to
+// log in.
+func NewSFTP(u *url.URL) (*SFTP, error) {
+	config, err := getSSHConfig(u)
+
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+
+	if len(u.Port()) == 0 {
+		host = net.JoinHostPort(u.Hostname(), defaultSSHPort)
+	}
+
+	conn, err := ssh.Dial("tcp", host, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &SFTP{
+		Dir:    u.Path,
+		conn:   conn,
+		client: client,
+	}, nil
+}
+
+func getSSHConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	username := u.User.Username()
+
+	if len(username) == 0 {
+		current, err := user.Current()
+
+		if err != nil {
+			return nil, err
+		}
+
+		username = current.Username
+	}
+
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostsFile := os.Getenv("SSH_KNOWN_HOSTS")
+
+	if len(knownHostsFile) == 0 {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts: %s", err)
+	}
+
+	auth := []ssh.AuthMethod{}
+
+	if password, exists := u.User.Password(); exists {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); len(socket) != 0 {
+		agentConn, err := net.Dial("unix", socket)
+
+		if err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+
+	signers := []ssh.Signer{}
+
+	for _, identityFile := range identityFiles {
+		key, err := ioutil.ReadFile(filepath.Join(home, ".ssh", identityFile))
+
+		if err != nil {
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+
+		if err != nil {
+			continue
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) != 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func (backend *SFTP) path(name string) string {
+	return path.Join(backend.Dir, name)
+}
+
+// Put writes data to a temporary file first, which is then renamed to name.
+func (backend *SFTP) Put(name string, data []byte) error {
+	destPath := backend.path(name)
+	tmpPath := destPath + utils.TmpSuffix
+
+	err := backend.client.MkdirAll(path.Dir(destPath))
+
+	if err != nil {
+		return err
+	}
+
+	file, err := backend.client.Create(tmpPath)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		backend.client.Remove(tmpPath)
+		return err
+	}
+
+	return backend.rename(tmpPath, destPath)
+}
+
+func (backend *SFTP) Get(name string) ([]byte, error) {
+	file, err := backend.client.Open(backend.path(name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+func (backend *SFTP) GetRange(name string, offset uint64, length uint64) ([]byte, error) {
+	file, err := backend.client.Open(backend.path(name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	data := make([]byte, length)
+	_, err = file.ReadAt(data, int64(offset))
+
+	if err == io.EOF {
+		return nil, ErrTruncated
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (backend *SFTP) Stat(name string) (FileInfo, error) {
+	fileInfo, err := backend.client.Stat(backend.path(name))
+
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Name: name, Size: uint64(fileInfo.Size())}, nil
+}
+
+func (backend *SFTP) List(prefix string, fn func(file FileInfo) error) error {
+	walker := backend.client.Walk(backend.path(prefix))
+
+	for walker.Step() {
+		err := walker.Err()
+
+		if errors.Is(err, os.ErrNotExist) && walker.Path() == backend.path(prefix) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if walker.Stat().IsDir() {
+			continue
+		}
+
+		name := walker.Path()[len(backend.Dir):]
+
+		if len(name) != 0 && name[0] == '/' {
+			name = name[1:]
+		}
+
+		err = fn(FileInfo{Name: name, Size: uint64(walker.Stat().Size())})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (backend *SFTP) Delete(name string) error {
+	return backend.client.Remove(backend.path(name))
+}
+
+func (backend *SFTP) Rename(oldName string, newName string) error {
+	err := backend.client.MkdirAll(path.Dir(backend.path(newName)))
+
+	if err != nil {
+		return err
+	}
+
+	return backend.rename(backend.path(oldName), backend.path(newName))
+}
+
+// rename replaces newPath with oldPath. Plain SFTP renames fail if newPath
+// exists, so the POSIX rename extension of OpenSSH is preferred.
+func (backend *SFTP) rename(oldPath string, newPath string) error {
+	if _, ok := backend.client.HasExtension("posix-rename@openssh.com"); ok {
+		return backend.client.PosixRename(oldPath, newPath)
+	}
+
+	err := backend.client.Remove(newPath)
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return backend.client.Rename(oldPath, newPath)
+}
+
+func (backend *SFTP) Close() error {
+	backend.client.Close()
+	return backend.conn.Close()
+}
+
+// SFTP status codes of errors that are not resolved by retrying. Only
+// permission denied is part of version 3 of the protocol, the other codes
+// were added in later versions but are sent by some servers.
+const (
+	sftpPermissionDenied    = 3
+	sftpWriteProtect        = 12
+	sftpNoSpaceOnFilesystem = 14
+	sftpQuotaExceeded       = 15
+	sftpInvalidFilename     = 20
+)
+
+// isPermanentSFTPError returns true if err is a status from the server that
+// will not change when the request is retried.
+func isPermanentSFTPError(err error) bool {
+	var statusErr *sftp.StatusError
+
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	switch statusErr.Code {
+	case sftpPermissionDenied, sftpWriteProtect, sftpNoSpaceOnFilesystem, sftpQuotaExceeded, sftpInvalidFilename:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,379 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// webDAVTestServer is a WebDAV server with an in-memory file system that
+// records the requests it receives.
+type webDAVTestServer struct {
+	fs      webdav.FileSystem
+	handler http.Handler
+
+	requests     []string
+	requestsLock sync.Mutex
+}
+
+func newWebDAVTestServer() *webDAVTestServer {
+	fs := webdav.NewMemFS()
+
+	return &webDAVTestServer{
+		fs: fs,
+		handler: &webdav.Handler{
+			FileSystem: fs,
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+}
+
+func (server *webDAVTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.requestsLock.Lock()
+	server.requests = append(server.requests, r.Method+" "+r.URL.Path)
+	server.requestsLock.Unlock()
+
+	server.handler.ServeHTTP(w, r)
+}
+
+// getRequests returns the recorded requests with method and clears them.
+func (server *webDAVTestServer) getRequests(method string) []string {
+	server.requestsLock.Lock()
+	defer server.requestsLock.Unlock()
+
+	requests := []string{}
+
+	for _, request := range server.requests {
+		if strings.HasPrefix(request, method+" ") {
+			requests = append(requests, request)
+		}
+	}
+
+	server.requests = nil
+
+	return requests
+}
+
+// startWebDAV starts handler and returns a backend for the collection p on
+// it.
+func startWebDAV(t *testing.T, handler http.Handler, p string) *WebDAV {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewWebDAV(&url.URL{
+		Scheme: schemeWebDAV,
+		User:   url.UserPassword("test", "secret"),
+		Host:   u.Host,
+		Path:   p,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		backend.Close()
+	})
+
+	return backend
+}
+
+func TestWebDAV(t *testing.T) {
+	testBackend(t, startWebDAV(t, newWebDAVTestServer(), "/archive"))
+}
+
+func TestWebDAVMkcolParents(t *testing.T) {
+	server := newWebDAVTestServer()
+	backend := startWebDAV(t, server, "/dav/archive")
+
+	mustPut(t, backend, "aa/aabb/aabbcc.bin", []byte("x"))
+
+	// The first MKCOL fails with 409 Conflict as its parents are missing.
+	want := []string{
+		"MKCOL /dav/archive/aa/aabb/",
+		"MKCOL /dav/archive/aa/",
+		"MKCOL /dav/archive/",
+		"MKCOL /dav/",
+		"MKCOL /dav/archive/",
+		"MKCOL /dav/archive/aa/",
+		"MKCOL /dav/archive/aa/aabb/",
+	}
+
+	if got := server.getRequests("MKCOL"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got the requests %v, want %v", got, want)
+	}
+
+	mustPut(t, backend, "aa/aabb/aabbdd.bin", []byte("y"))
+	mustPut(t, backend, "aa/aacc/aaccdd.bin", []byte("z"))
+
+	want = []string{"MKCOL /dav/archive/aa/aacc/"}
+
+	if got := server.getRequests("MKCOL"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("existing collections were created again: got %v, want %v", got, want)
+	}
+}
+
+func TestWebDAVListRecursion(t *testing.T) {
+	server := newWebDAVTestServer()
+	backend := startWebDAV(t, server, "/archive")
+
+	for _, name := range []string{"index.json.gz.bin", "aa/aabb/aabbcc.bin", "aa/aacc/aaccdd.bin", "packs/p1/p1.pack"} {
+		mustPut(t, backend, name, []byte(name))
+	}
+
+	server.getRequests("")
+
+	var names []string
+
+	err := backend.List("", func(file FileInfo) error {
+		if file.Size != uint64(len(file.Name)) {
+			t.Errorf("%s has %d bytes, want %d", file.Name, file.Size, len(file.Name))
+		}
+
+		names = append(names, file.Name)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(names)
+	want := "[aa/aabb/aabbcc.bin aa/aacc/aaccdd.bin index.json.gz.bin packs/p1/p1.pack]"
+
+	if fmt.Sprint(names) != want {
+		t.Fatalf("List returned %v, want %s", names, want)
+	}
+
+	// Every collection is listed with its own PROPFIND request with depth 1.
+	propfinds := server.getRequests("PROPFIND")
+	sort.Strings(propfinds)
+	wantPropfinds := "[PROPFIND /archive/ PROPFIND /archive/aa/ PROPFIND /archive/aa/aabb/ PROPFIND /archive/aa/aacc/ PROPFIND /archive/packs/ PROPFIND /archive/packs/p1/]"
+
+	if fmt.Sprint(propfinds) != wantPropfinds {
+		t.Fatalf("got the requests %v, want %s", propfinds, wantPropfinds)
+	}
+}
+
+func TestWebDAVStatNotExist(t *testing.T) {
+	backend := startWebDAV(t, newWebDAVTestServer(), "/archive")
+
+	_, err := backend.Stat("aa/aabb/missing.bin")
+
+	if !os.IsNotExist(err) {
+		t.Fatalf("Stat returned %v, want an error that satisfies os.IsNotExist", err)
+	}
+
+	err = backend.Delete("aa/aabb/missing.bin")
+
+	if !os.IsNotExist(err) {
+		t.Fatalf("Delete returned %v, want an error that satisfies os.IsNotExist", err)
+	}
+}
+
+// TestWebDAVGetRange tests range requests on a server that answers with 206
+// Partial Content and on one that ignores the Range header.
+func TestWebDAVGetRange(t *testing.T) {
+	server := newWebDAVTestServer()
+
+	noRanges := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Range")
+		server.ServeHTTP(w, r)
+	})
+
+	for _, test := range []struct {
+		name    string
+		handler http.Handler
+	}{
+		{"PartialContent", server},
+		{"NoRanges", noRanges},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backend := startWebDAV(t, test.handler, "/archive")
+			mustPut(t, backend, "range.pack", []byte("0123456789"))
+
+			got, err := backend.GetRange("range.pack", 3, 4)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != "3456" {
+				t.Fatalf("GetRange returned %q, want %q", got, "3456")
+			}
+
+			for _, r := range [][2]uint64{{5, 10}, {10, 1}} {
+				_, err = backend.GetRange("range.pack", r[0], r[1])
+
+				if !errors.Is(err, ErrTruncated) {
+					t.Fatalf("GetRange(%d, %d) returned %v, want ErrTruncated", r[0], r[1], err)
+				}
+			}
+		})
+	}
+}
+
+// TestWebDAVChunkedUpload uploads files in parts like to a Nextcloud server.
+// The MOVE of the .file pseudo file, which assembles the parts, is emulated.
+func TestWebDAVChunkedUpload(t *testing.T) {
+	server := newWebDAVTestServer()
+	ctx := context.Background()
+
+	for _, dir := range []string{"/remote.php", "/remote.php/dav", "/remote.php/dav/uploads", "/remote.php/dav/uploads/test"} {
+		err := server.fs.Mkdir(ctx, dir, 0700)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var moves []string
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "MOVE" || !strings.HasSuffix(r.URL.Path, "/.file") {
+			server.ServeHTTP(w, r)
+			return
+		}
+
+		moves = append(moves, r.URL.Path)
+		status, err := assembleWebDAVUpload(ctx, server.fs, r)
+
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.WriteHeader(status)
+	})
+
+	backend := startWebDAV(t, handler, "/remote.php/dav/files/test/archive")
+	backend.ChunkSize = 4
+
+	data := []byte("0123456789")
+	mustPut(t, backend, "packs/large.pack", data)
+
+	parts := server.getRequests(http.MethodPut)
+
+	if len(parts) != 3 {
+		t.Fatalf("got the uploads %v, want 3 parts", parts)
+	}
+
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "PUT /remote.php/dav/uploads/test/sfa-") || !strings.HasSuffix(part, fmt.Sprintf("/%05d", i+1)) {
+			t.Fatalf("part %d was uploaded as %s", i+1, part)
+		}
+	}
+
+	if len(moves) != 1 {
+		t.Fatalf("got the moves %v, want 1", moves)
+	}
+
+	got, err := backend.Get("packs/large.pack")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Get returned %q, want %q", got, data)
+	}
+
+	mustPut(t, backend, "packs/small.pack", []byte("0123"))
+
+	if parts := server.getRequests(http.MethodPut); len(parts) != 1 || !strings.HasSuffix(parts[0], "/archive/packs/small.pack.tmp") {
+		t.Fatalf("small file was uploaded with %v", parts)
+	}
+}
+
+// assembleWebDAVUpload concatenates the parts of the upload collection of
+// the .file pseudo file in r to the destination of r, like Nextcloud does.
+func assembleWebDAVUpload(ctx context.Context, fs webdav.FileSystem, r *http.Request) (int, error) {
+	upload := strings.TrimSuffix(r.URL.Path, ".file")
+	dir, err := fs.OpenFile(ctx, upload, os.O_RDONLY, 0)
+
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	var data bytes.Buffer
+
+	for _, info := range infos {
+		file, err := fs.OpenFile(ctx, upload+info.Name(), os.O_RDONLY, 0)
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		_, err = io.Copy(&data, file)
+		file.Close()
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if total := r.Header.Get("OC-Total-Length"); total != strconv.Itoa(data.Len()) {
+		return http.StatusBadRequest, fmt.Errorf("OC-Total-Length is %s, the parts have %d bytes", total, data.Len())
+	}
+
+	if r.Header.Get("Overwrite") != "T" {
+		return http.StatusBadRequest, fmt.Errorf("Overwrite is not T")
+	}
+
+	destination, err := url.Parse(r.Header.Get("Destination"))
+
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	file, err := fs.OpenFile(ctx, destination.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return http.StatusConflict, err
+	}
+
+	_, err = file.Write(data.Bytes())
+	file.Close()
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	err = fs.RemoveAll(ctx, upload)
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusCreated, nil
+}
@@ -0,0 +1,28 @@
+module github.com/srhnsn/securefilearchiver
+
+go 1.22
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/minio/minio-go/v7 v7.0.80
+	github.com/pkg/sftp v1.13.7
+	github.com/ryanuber/go-glob v1.0.0
+	golang.org/x/crypto v0.30.0
+	golang.org/x/net v0.30.0
+	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+)
+
+require (
+	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
+	github.com/alecthomas/units v0.0.0-20240927000941-0f3dac36c52b // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-ini/ini v1.67.0 // indirect
+	github.com/goccy/go-json v0.10.3 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/minio/md5-simd v1.1.2 // indirect
+	github.com/rs/xid v1.6.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
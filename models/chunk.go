@@ -1,7 +1,39 @@
 package models
 
-// Chunk represents a part of a file.
+const (
+	// CompressionGzip marks chunks that were compressed with gzip before
+	// encryption.
+	CompressionGzip = "gzip"
+	// CompressionZstd marks chunks that were compressed with Zstandard before
+	// encryption.
+	CompressionZstd = "zstd"
+
+	// EncryptionOpenPGP marks chunks that were encrypted with symmetric
+	// OpenPGP encryption, using the document key as passphrase.
+	EncryptionOpenPGP = "openpgp"
+	// EncryptionHKDF marks chunks that were encrypted with AES-256-GCM and a
+	// key derived from the document key with HKDF.
+	EncryptionHKDF = "hkdf"
+
+	// ChunkNamesHMAC marks archives whose chunk names are HMAC-SHA256 sums of
+	// the chunk content, keyed with a secret derived from the document key.
+	// Archives without it use plain SHA-256 sums.
+	ChunkNamesHMAC = "hmac-sha256"
+)
+
+// Chunk represents a part of a file. Chunks are either stored in their own
+// file or, if Pack is set, as Length bytes at Offset in a pack file.
+// Compression is empty for chunks that were stored uncompressed, Encryption is
+// empty for chunks that were encrypted with OpenPGP. CiphertextHash is the
+// SHA-256 sum of the stored (encrypted) data, it is empty for chunks that were
+// archived before it was introduced.
 type Chunk struct {
-	Name string `json:"n"`
-	Size uint64 `json:"s"`
+	Name           string `json:"n"`
+	Size           uint64 `json:"s"`
+	Pack           string `json:"p,omitempty"`
+	Offset         uint64 `json:"o,omitempty"`
+	Length         uint64 `json:"l,omitempty"`
+	Compression    string `json:"z,omitempty"`
+	Encryption     string `json:"e,omitempty"`
+	CiphertextHash string `json:"c,omitempty"`
 }
@@ -0,0 +1,23 @@
+package models
+
+const (
+	// ChunkingFixed cuts files into chunks of AvgSize bytes.
+	ChunkingFixed = "fixed"
+	// ChunkingContentDefined cuts files at content-defined boundaries into
+	// chunks between MinSize and MaxSize bytes.
+	ChunkingContentDefined = "cdc"
+
+	// ChunkPolicyConstant uses the configured chunk sizes for all files.
+	ChunkPolicyConstant = "constant"
+	// ChunkPolicySizeAware scales the configured chunk sizes up for large files.
+	ChunkPolicySizeAware = "size-aware"
+)
+
+// Chunking describes how files are split into chunks.
+type Chunking struct {
+	Mode    string `json:"mode"`
+	MinSize uint64 `json:"min,omitempty"`
+	AvgSize uint64 `json:"avg"`
+	MaxSize uint64 `json:"max,omitempty"`
+	Policy  string `json:"policy,omitempty"`
+}
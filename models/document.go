@@ -2,6 +2,7 @@ package models
 
 import (
 	"sort"
+	"time"
 )
 
 // Document represents the index which stores all metadata about the archived files.
@@ -11,6 +12,33 @@ type Document struct {
 	KeyUnencrypted string            `json:"-"`
 	Files          map[string]File   `json:"files"`
 	DeletedFiles   map[string][]File `json:"deleted_files"`
+	Chunking       *Chunking         `json:"chunking,omitempty"`
+	Packing        *Packing          `json:"packing,omitempty"`
+	Compression    string            `json:"compression,omitempty"`
+	Encryption     string            `json:"encryption,omitempty"`
+	ChunkNames     string            `json:"chunk_names,omitempty"`
+	// UnmigratedChunks lists the chunks of an archive with keyed chunk
+	// names that could not be migrated and still have plain SHA-256 names.
+	UnmigratedChunks []string     `json:"unmigrated_chunks,omitempty"`
+	Runs             []ArchiveRun `json:"runs,omitempty"`
+}
+
+// ForEachChunk calls fn for every chunk of every file and deleted file version.
+// fn may modify the chunk.
+func (doc *Document) ForEachChunk(fn func(chunk *Chunk)) {
+	for _, file := range doc.Files {
+		for i := range file.Chunks {
+			fn(&file.Chunks[i])
+		}
+	}
+
+	for _, versions := range doc.DeletedFiles {
+		for _, file := range versions {
+			for i := range file.Chunks {
+				fn(&file.Chunks[i])
+			}
+		}
+	}
 }
 
 // GetSortedFilesKeys returns sorted Document.Files keys.
@@ -24,3 +52,78 @@ func (doc *Document) GetSortedFilesKeys() []string {
 	sort.Strings(result)
 	return result
 }
+
+// GetSortedDeletedFilesKeys returns sorted Document.DeletedFiles keys.
+func (doc *Document) GetSortedDeletedFilesKeys() []string {
+	result := []string{}
+
+	for key := range doc.DeletedFiles {
+		result = append(result, key)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// GetFileVersions returns all stored versions of shortPath, oldest first. The
+// current version, if the path still exists, is the last one.
+func (doc *Document) GetFileVersions(shortPath string) []File {
+	versions := []File{}
+	versions = append(versions, doc.DeletedFiles[shortPath]...)
+
+	file, exists := doc.Files[shortPath]
+
+	if exists {
+		versions = append(versions, file)
+	}
+
+	return versions
+}
+
+// GetFilesAt returns the files as they existed at t, including files that
+// were deleted since then.
+func (doc *Document) GetFilesAt(t time.Time) map[string]File {
+	result := map[string]File{}
+
+	for shortPath := range doc.Files {
+		if file, exists := getVersionAt(doc.GetFileVersions(shortPath), t); exists {
+			result[shortPath] = file
+		}
+	}
+
+	for shortPath := range doc.DeletedFiles {
+		if file, exists := getVersionAt(doc.GetFileVersions(shortPath), t); exists {
+			result[shortPath] = file
+		}
+	}
+
+	return result
+}
+
+// GetVersionStart returns the time at which versions[i] became the current
+// version. AddedAt is kept when a file is changed, so a version that
+// replaced an older one starts when the older one was deleted.
+func GetVersionStart(versions []File, i int) time.Time {
+	start := versions[i].AddedAt.Time
+
+	if i > 0 && versions[i-1].DeletedAt != nil && versions[i-1].DeletedAt.Time.After(start) {
+		start = versions[i-1].DeletedAt.Time
+	}
+
+	return start
+}
+
+// getVersionAt returns the version in versions that was current at t.
+func getVersionAt(versions []File, t time.Time) (File, bool) {
+	for i, file := range versions {
+		if t.Before(GetVersionStart(versions, i)) {
+			continue
+		}
+
+		if file.DeletedAt == nil || t.Before(file.DeletedAt.Time) {
+			return file, true
+		}
+	}
+
+	return File{}, false
+}
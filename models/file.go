@@ -1,6 +1,7 @@
 package models
 
 // File represents a file on the user's system. It consists of one or more chunks.
+// Hash is the SHA-256 checksum of the whole file content.
 type File struct {
 	ModificationTime JSONTime  `json:"m"`
 	AddedAt          JSONTime  `json:"a"`
@@ -8,4 +9,5 @@ type File struct {
 	Size             uint64    `json:"s,omitempty"`
 	IsDirectory      bool      `json:"i,omitempty"`
 	Chunks           []Chunk   `json:"c,omitempty"`
+	Hash             string    `json:"h,omitempty"`
 }
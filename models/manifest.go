@@ -0,0 +1,25 @@
+package models
+
+// ManifestVersion is the current version of the manifest format. Version 1
+// manifests also contain the names of chunks in pack files.
+const ManifestVersion = 2
+
+// Manifest lists the stored chunks of an archive with the SHA-256 sums of
+// their encrypted data. It is stored unencrypted next to the index, so that
+// the integrity of the chunks can be checked without the password. It only
+// contains what can be seen in the archive anyway.
+type Manifest struct {
+	Version uint8           `json:"version"`
+	Chunks  []ManifestChunk `json:"chunks"`
+}
+
+// ManifestChunk is a stored chunk in a Manifest. Like in Chunk, chunks in pack
+// files are Length bytes at Offset in the pack file Pack. Name is only set for
+// chunks in their own files, as it is part of the file name.
+type ManifestChunk struct {
+	Name           string `json:"n,omitempty"`
+	Pack           string `json:"p,omitempty"`
+	Offset         uint64 `json:"o,omitempty"`
+	Length         uint64 `json:"l,omitempty"`
+	CiphertextHash string `json:"c,omitempty"`
+}
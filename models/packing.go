@@ -0,0 +1,7 @@
+package models
+
+// Packing describes how small chunks are bundled into pack files.
+type Packing struct {
+	Size         uint64 `json:"size"`
+	MaxChunkSize uint64 `json:"max_chunk_size"`
+}
@@ -0,0 +1,15 @@
+package models
+
+// ArchiveRun describes a single run of the archive command. StoredData is the
+// size of the encrypted chunks that were written during the run.
+type ArchiveRun struct {
+	Start          JSONTime `json:"start"`
+	End            JSONTime `json:"end"`
+	ProcessedFiles uint64   `json:"processed_files"`
+	ProcessedData  uint64   `json:"processed_data"`
+	SkippedFiles   uint64   `json:"skipped_files"`
+	DeletedFiles   uint64   `json:"deleted_files"`
+	NewChunks      uint64   `json:"new_chunks"`
+	StoredData     uint64   `json:"stored_data"`
+	FailedFiles    uint64   `json:"failed_files,omitempty"`
+}
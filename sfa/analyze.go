@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// ChunkingAnalysis holds the results of simulating one chunking configuration
+// on a source directory. With Packing, unique chunks that would be bundled
+// into pack files are counted in PackFiles instead of ChunkFiles.
+type ChunkingAnalysis struct {
+	Chunking     models.Chunking
+	Packing      *models.Packing
+	Chunks       uint64
+	Data         uint64
+	UniqueChunks map[[sha256.Size]byte]bool
+	UniqueData   uint64
+	ChunkFiles   uint64
+	PackFiles    uint64
+	packData     uint64
+	packOpen     bool
+}
+
+func (analysis *ChunkingAnalysis) addFile(reader io.Reader, size uint64) error {
+	chunker := newChunker(reader, size, analysis.Chunking)
+
+	for {
+		data, err := chunker.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256(data)
+
+		analysis.Chunks++
+		analysis.Data += uint64(len(data))
+
+		if analysis.UniqueChunks[hash] {
+			continue
+		}
+
+		analysis.UniqueChunks[hash] = true
+		analysis.UniqueData += uint64(len(data))
+		analysis.addStoredChunk(uint64(len(data)))
+	}
+}
+
+// addStoredChunk counts the file that a new chunk of size bytes is stored in.
+// Like ChunkStore.Save, a pack file is finished once it reaches the pack size.
+// Compression and encryption are ignored.
+func (analysis *ChunkingAnalysis) addStoredChunk(size uint64) {
+	if analysis.Packing == nil || size > analysis.Packing.MaxChunkSize {
+		analysis.ChunkFiles++
+		return
+	}
+
+	if !analysis.packOpen {
+		analysis.PackFiles++
+		analysis.packOpen = true
+	}
+
+	analysis.packData += size
+
+	if analysis.packData >= analysis.Packing.Size {
+		analysis.packData = 0
+		analysis.packOpen = false
+	}
+}
+
+func analyzeChunking(inputDir string) {
+	analyses := getChunkingAnalyses()
+	excludes := getExcludes(*analyzeExcludes)
+
+	var noFiles uint64
+
+	utils.Info.Printf("simulating %d chunking configurations", len(analyses))
+
+	// The same paths as in archive are analyzed.
+	walkFn := walkSourceFn(inputDir, "", excludes, *analyzeSymlinks, func(fullPath string, shortPath string, fileInfo os.FileInfo) error {
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		utils.Trace.Printf("analyzing %s", shortPath)
+		err := analyzeFile(fullPath, uint64(fileInfo.Size()), analyses)
+
+		if err != nil {
+			utils.Error.Printf("error while analyzing %s: %s", fullPath, err)
+			return nil
+		}
+
+		noFiles++
+
+		return nil
+	})
+
+	err := filepath.Walk(inputDir, walkFn)
+
+	utils.PanicIfErr(err)
+
+	utils.Info.Printf("analyzed %d files", noFiles)
+	printChunkingAnalyses(analyses)
+}
+
+// analyzeFile reads the file at fullPath once and feeds it to all analyses
+// concurrently.
+func analyzeFile(fullPath string, size uint64, analyses []*ChunkingAnalysis) error {
+	file, err := os.Open(fullPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	writers := make([]io.Writer, len(analyses))
+	pipeWriters := make([]*io.PipeWriter, len(analyses))
+	results := make(chan error, len(analyses))
+
+	for i, analysis := range analyses {
+		pipeReader, pipeWriter := io.Pipe()
+		writers[i] = pipeWriter
+		pipeWriters[i] = pipeWriter
+
+		go func(analysis *ChunkingAnalysis, reader *io.PipeReader) {
+			err := analysis.addFile(reader, size)
+			reader.CloseWithError(err)
+			results <- err
+		}(analysis, pipeReader)
+	}
+
+	_, err = io.Copy(io.MultiWriter(writers...), file)
+
+	for _, pipeWriter := range pipeWriters {
+		pipeWriter.CloseWithError(err)
+	}
+
+	for range analyses {
+		result := <-results
+
+		if err == nil {
+			err = result
+		}
+	}
+
+	return err
+}
+
+func getChunkingAnalyses() []*ChunkingAnalysis {
+	analyses := []*ChunkingAnalysis{}
+	packing := getPacking(nil, *analyzePackSize, uint64(*analyzePackChunkMax))
+
+	for _, chunkSizeStr := range *analyzeChunkSizes {
+		chunkSize, err := utils.ParseFileSize(chunkSizeStr)
+
+		utils.PanicIfErr(err)
+
+		for _, mode := range []string{models.ChunkingFixed, models.ChunkingContentDefined} {
+			for _, policy := range []string{models.ChunkPolicyConstant, models.ChunkPolicySizeAware} {
+				chunking := models.Chunking{
+					Mode:    mode,
+					AvgSize: chunkSize,
+					Policy:  policy,
+				}
+
+				if mode == models.ChunkingContentDefined {
+					chunking.MinSize = chunkSize / 4
+					chunking.MaxSize = chunkSize * 4
+				}
+
+				err = validateChunking(chunking)
+
+				utils.PanicIfErr(err)
+
+				analyses = append(analyses, &ChunkingAnalysis{
+					Chunking:     chunking,
+					Packing:      packing,
+					UniqueChunks: map[[sha256.Size]byte]bool{},
+				})
+			}
+		}
+	}
+
+	return analyses
+}
+
+func printChunkingAnalyses(analyses []*ChunkingAnalysis) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintln(writer, "Mode\tChunk size\tPolicy\tChunks\tUnique chunks\tAvg. chunk size\tDedup ratio\tChunk files\tPack files\tProjected files\t")
+
+	for _, analysis := range analyses {
+		uniqueChunks := uint64(len(analysis.UniqueChunks))
+
+		var avgChunkSize uint64
+		dedupRatio := 1.0
+
+		if uniqueChunks > 0 {
+			avgChunkSize = analysis.UniqueData / uniqueChunks
+		}
+
+		if analysis.UniqueData > 0 {
+			dedupRatio = float64(analysis.Data) / float64(analysis.UniqueData)
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%s\t%.2f\t%d\t%d\t%d\t\n",
+			analysis.Chunking.Mode,
+			utils.FormatFileSize(analysis.Chunking.AvgSize),
+			analysis.Chunking.Policy,
+			analysis.Chunks,
+			uniqueChunks,
+			utils.FormatFileSize(avgChunkSize),
+			dedupRatio,
+			analysis.ChunkFiles,
+			analysis.PackFiles,
+			// The chunk and pack files plus the index.
+			analysis.ChunkFiles+analysis.PackFiles+1,
+		)
+	}
+
+	err := writer.Flush()
+
+	utils.PanicIfErr(err)
+}
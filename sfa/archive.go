@@ -1,12 +1,15 @@
 package main
 
 import (
-	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/srhnsn/securefilearchiver/backend"
 	"github.com/srhnsn/securefilearchiver/models"
 	"github.com/srhnsn/securefilearchiver/utils"
 )
@@ -19,6 +22,7 @@ const (
 // ArchiveInfo is a struct which holds all needed information for archiving
 // a specific file. It is merely a convenience struct for passing in functions.
 type ArchiveInfo struct {
+	Chunks    *ChunkStore
 	Document  *models.Document
 	File      models.File
 	FileInfo  os.FileInfo
@@ -30,13 +34,49 @@ type ArchiveInfo struct {
 }
 
 // ProgressInfo holds all information that describes the current status
-// when archiving files.
+// when archiving files. The counters must only be accessed atomically.
 type ProgressInfo struct {
-	CurrentFile    string
 	ProcessedData  uint64
 	ProcessedFiles uint64
 	SkippedData    uint64
 	SkippedFiles   uint64
+
+	currentFile     string
+	currentFileLock sync.Mutex
+}
+
+// AddProcessed counts a file of size bytes as processed.
+func (progressInfo *ProgressInfo) AddProcessed(size uint64) {
+	atomic.AddUint64(&progressInfo.ProcessedData, size)
+	atomic.AddUint64(&progressInfo.ProcessedFiles, 1)
+}
+
+// RemoveProcessed no longer counts a file of size bytes as processed.
+func (progressInfo *ProgressInfo) RemoveProcessed(size uint64) {
+	atomic.AddUint64(&progressInfo.ProcessedData, ^(size - 1))
+	atomic.AddUint64(&progressInfo.ProcessedFiles, ^uint64(0))
+}
+
+// AddSkipped counts a file of size bytes as skipped.
+func (progressInfo *ProgressInfo) AddSkipped(size uint64) {
+	atomic.AddUint64(&progressInfo.SkippedData, size)
+	atomic.AddUint64(&progressInfo.SkippedFiles, 1)
+}
+
+// GetCurrentFile returns the file that was last found while walking.
+func (progressInfo *ProgressInfo) GetCurrentFile() string {
+	progressInfo.currentFileLock.Lock()
+	defer progressInfo.currentFileLock.Unlock()
+
+	return progressInfo.currentFile
+}
+
+// SetCurrentFile sets the file that was last found while walking.
+func (progressInfo *ProgressInfo) SetCurrentFile(shortPath string) {
+	progressInfo.currentFileLock.Lock()
+	defer progressInfo.currentFileLock.Unlock()
+
+	progressInfo.currentFile = shortPath
 }
 
 func addToDeletedFiles(archive *ArchiveInfo) {
@@ -56,7 +96,7 @@ func addToDeletedFiles(archive *ArchiveInfo) {
 	}
 }
 
-func archiveFile(archive *ArchiveInfo, exists bool) error {
+func archiveFile(archive *ArchiveInfo, exists bool, chunks []models.Chunk, hash string) {
 	file := models.File{
 		ModificationTime: models.JSONTime{Time: archive.FileInfo.ModTime()},
 	}
@@ -64,13 +104,8 @@ func archiveFile(archive *ArchiveInfo, exists bool) error {
 	if archive.FileInfo.IsDir() {
 		file.IsDirectory = true
 	} else {
-		chunks, err := createAndGetChunks(archive)
-
-		if err != nil {
-			return err
-		}
-
 		file.Chunks = chunks
+		file.Hash = hash
 		file.Size = archive.FileSize
 	}
 
@@ -81,72 +116,22 @@ func archiveFile(archive *ArchiveInfo, exists bool) error {
 	}
 
 	archive.Document.Files[archive.ShortPath] = file
-
-	return nil
 }
 
-func chunkExists(chunkName string, archive *ArchiveInfo) bool {
-	chunkPath := filepath.Join(archive.OutputDir, chunkName[:2], chunkName[:4], chunkName+EncSuffix)
-	return utils.FileExists(chunkPath)
-}
-
-func createAndGetChunks(archive *ArchiveInfo) ([]models.Chunk, error) {
-	if archive.FileInfo.IsDir() {
-		return []models.Chunk{}, nil
-	}
-
-	file, err := os.Open(archive.FullPath)
-
-	if err != nil {
-		return nil, err
+// chunksAreEqual returns true if a and b consist of the same chunks in the
+// same order.
+func chunksAreEqual(a []models.Chunk, b []models.Chunk) bool {
+	if len(a) != len(b) {
+		return false
 	}
 
-	defer file.Close()
-
-	var chunks []models.Chunk
-	chunkSize := getChunkSize(archive.FileSize)
-
-	chunkNo := 0
-
-	utils.Trace.Printf("writing chunks for %s\n", archive.ShortPath)
-
-	for {
-		chunkNo++
-		data := make([]byte, chunkSize)
-
-		n, err := file.Read(data)
-
-		if err != nil {
-			if err != io.EOF {
-				utils.Error.Println(err)
-			}
-
-			break
-		}
-
-		if uint64(n) < chunkSize {
-			data = data[:n]
-		}
-
-		name := utils.GetHashSum(data)
-		chunkFilename := name + EncSuffix
-
-		if chunkExists(name, archive) {
-			utils.Trace.Printf("chunk #%d (%s) seems to already exist\n", chunkNo, chunkFilename)
-		} else {
-			utils.Trace.Printf("writing chunk #%d (%s)\n", chunkNo, chunkFilename)
-			ciphertext := utils.EncryptData(data, archive.Document.KeyUnencrypted)
-
-			saveChunk(archive.OutputDir, chunkFilename, ciphertext)
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
 		}
-
-		chunks = append(chunks, models.Chunk{
-			Name: name,
-			Size: uint64(n),
-		})
 	}
 
-	return chunks, nil
+	return true
 }
 
 func fileHasChanged(archive *ArchiveInfo) bool {
@@ -167,8 +152,20 @@ func fileHasChanged(archive *ArchiveInfo) bool {
 	return false
 }
 
-func getChunkSize(size uint64) uint64 {
-	return 1024 * 1024
+// getExcludes reads the exclude file filename. An empty filename results in
+// an empty Globfile.
+func getExcludes(filename string) utils.Globfile {
+	if len(filename) == 0 {
+		return utils.Globfile{}
+	}
+
+	excludes, err := utils.NewGlobfile(filename)
+
+	utils.PanicIfErr(err)
+
+	utils.Info.Printf("using exclude file %s (%d globs)", filename, excludes.Len())
+
+	return excludes
 }
 
 func getPassword() string {
@@ -196,7 +193,13 @@ func markRemovedPaths(removedPaths map[string]bool, doc *models.Document) {
 	}
 }
 
+// normalizePath returns the absolute path of a local directory. Backend URLs
+// are returned unchanged.
 func normalizePath(path string) string {
+	if backend.IsURL(path) {
+		return path
+	}
+
 	path, err := filepath.Abs(path)
 
 	utils.PanicIfErr(err)
@@ -207,107 +210,161 @@ func normalizePath(path string) string {
 	return path
 }
 
-func saveChunk(outputDir string, filename string, data []byte) {
-	destDir := filepath.Join(outputDir, filename[0:2], filename[0:4])
-	destPath := filepath.Join(destDir, filename)
+// trustMtime returns false if the content of files with unchanged size and
+// modification time is to be checked as well (--trust-mtime=false).
+func trustMtime() bool {
+	return *archiveTrustMtime != "false"
+}
 
-	err := os.MkdirAll(destDir, 0700)
+// updateFileMetadata updates the index entry of a file whose content did not
+// change, without creating a new version.
+func updateFileMetadata(archive *ArchiveInfo, hash string) {
+	file := archive.File
+	file.ModificationTime = models.JSONTime{Time: archive.FileInfo.ModTime()}
 
-	utils.PanicIfErr(err)
+	if len(hash) != 0 {
+		file.Hash = hash
+	}
 
-	utils.MustWriteFileAtomic(destPath, data)
+	archive.Document.Files[archive.ShortPath] = file
+}
+
+// useChecksums returns true if the content of files is compared by their hash
+// (--checksum or --trust-mtime=false).
+func useChecksums() bool {
+	return *archiveChecksum || !trustMtime()
 }
 
 func walkDirectory(inputDir string, outputDir string) {
-	doc, err := readIndex(getExistingIndexFilename(outputDir))
+	doc, err := readIndex(outputDir)
 
 	utils.PanicIfErr(err)
 
+	applyChunkingFlags(doc)
+	utils.Info.Printf("using %s chunking", formatChunking(*doc.Chunking))
+	applyPackingFlags(doc)
+	applyCompressionFlags(doc)
+	applyEncryptionFlags(doc)
+
+	if !trustMtime() {
+		utils.Info.Println("checking the content of all files, this may take a while")
+	} else if *archiveChecksum {
+		utils.Info.Println("checking the content of files with changed modification times")
+	}
+
+	run := models.ArchiveRun{Start: models.JSONTime{Time: time.Now()}}
+	chunks := newChunkStore(outputDir, doc)
+
 	utils.Trace.Println("creating removed paths map")
 	removedPaths := getRemovedPathsMap(doc)
 
+	if *archiveJobs < 1 {
+		*archiveJobs = 1
+	}
+
 	var progressInfo ProgressInfo
 	done := make(chan bool)
 	saveTicker := time.NewTicker(indexSaveInterval)
 	startProgressUpdater(&progressInfo, done)
-	walkFn := walkDirectoryFn(inputDir, outputDir, doc, removedPaths, &progressInfo, saveTicker.C)
+	pipeline := newArchivePipeline(doc, chunks, outputDir, &progressInfo, saveTicker.C, *archiveJobs)
+	walkFn := walkDirectoryFn(inputDir, outputDir, pipeline, removedPaths, &progressInfo)
 
-	utils.Info.Println("checking for changed files")
+	utils.Info.Printf("checking for changed files (%d jobs)", *archiveJobs)
 	err = filepath.Walk(inputDir, walkFn)
 
 	utils.PanicIfErr(err)
 
+	pipeline.Close()
 	done <- true
 	saveTicker.Stop()
 
-	utils.Info.Println("checking for deleted files")
-	markRemovedPaths(removedPaths, doc)
-
-	saveIndex(getIndexFilename(outputDir), doc)
-}
-
-func walkDirectoryFn(
-	inputDir string,
-	outputDir string,
-	doc *models.Document,
-	removedPaths removedPathsMap,
-	progressInfo *ProgressInfo,
-	save <-chan time.Time,
-) filepath.WalkFunc {
+	// Paths that were not walked after the pipeline stopped are not deleted.
+	if pipeline.Stopped() {
+		removedPaths = removedPathsMap{}
+	} else {
+		utils.Info.Println("checking for deleted files")
+		markRemovedPaths(removedPaths, doc)
+	}
 
-	inputDirLength := len(inputDir) + 1
+	pipeline.Flush()
 
-	var excludes utils.Globfile
-	var err error
+	run.End = models.JSONTime{Time: time.Now()}
+	run.ProcessedFiles = progressInfo.ProcessedFiles
+	run.ProcessedData = progressInfo.ProcessedData
+	run.SkippedFiles = progressInfo.SkippedFiles
+	run.DeletedFiles = uint64(len(removedPaths))
+	run.NewChunks = chunks.SavedChunks
+	run.StoredData = chunks.SavedData
+	run.FailedFiles = uint64(len(pipeline.Failed))
+	doc.Runs = append(doc.Runs, run)
 
-	if len(*archiveExcludes) != 0 {
-		excludes, err = utils.NewGlobfile(*archiveExcludes)
+	printArchiveRun(run)
+	saveIndex(outputDir, doc)
 
-		utils.PanicIfErr(err)
+	if pipeline.Stopped() {
+		utils.Error.Printf("archiving was stopped after %d chunks in a row could not be written, the remaining files were not checked", maxWriteFailures)
+	}
 
-		utils.Info.Printf("using exclude file %s (%d globs)", *archiveExcludes, excludes.Len())
+	if len(pipeline.Failed) > 0 || pipeline.Stopped() {
+		printFailedFiles(pipeline.Failed)
+		closeBackends()
+		os.Exit(1)
 	}
+}
 
-	return func(fullPath string, fileInfo os.FileInfo, err error) error {
-		fullPath = utils.FixSlashes(fullPath)
+// printFailedFiles lists the files that could not be archived.
+func printFailedFiles(failed []string) {
+	sort.Strings(failed)
 
-		if err != nil {
-			utils.Error.Printf("error while walking %s: %s", fullPath, err)
-			return nil
-		}
+	utils.Error.Printf("%d files could not be archived and were left unchanged in the index:", len(failed))
 
-		// Do not walk output directory.
-		if fileInfo.IsDir() && strings.HasPrefix(fullPath, outputDir) {
-			return filepath.SkipDir
-		}
+	for _, shortPath := range failed {
+		utils.Error.Printf("    %s", shortPath)
+	}
+}
 
-		if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink && !*archiveSymlinks {
-			return filepath.SkipDir
-		}
+// printArchiveRun prints a summary of run. In a dry run, nothing was written.
+func printArchiveRun(run models.ArchiveRun) {
+	prefix := "archived"
 
-		var shortPath string
+	if *dryRun {
+		prefix = "dry run, would archive"
+	}
 
-		if len(fullPath) >= inputDirLength {
-			shortPath = fullPath[inputDirLength:]
-		}
+	utils.Info.Printf("%s %d files (%s) in %d new chunks (%s), skipped %d unchanged files, marked %d paths as deleted",
+		prefix,
+		run.ProcessedFiles,
+		utils.FormatFileSize(run.ProcessedData),
+		run.NewChunks,
+		utils.FormatFileSize(run.StoredData),
+		run.SkippedFiles,
+		run.DeletedFiles,
+	)
+}
 
-		if excludes.Matches(shortPath) {
-			utils.Trace.Printf("skipping %s because path is in exclude file", shortPath)
+func walkDirectoryFn(
+	inputDir string,
+	outputDir string,
+	pipeline *ArchivePipeline,
+	removedPaths removedPathsMap,
+	progressInfo *ProgressInfo,
+) filepath.WalkFunc {
 
-			if fileInfo.IsDir() {
-				return filepath.SkipDir
-			}
+	excludes := getExcludes(*archiveExcludes)
 
-			return nil
+	return walkSourceFn(inputDir, outputDir, excludes, *archiveSymlinks, func(fullPath string, shortPath string, fileInfo os.FileInfo) error {
+		if pipeline.Stopped() {
+			return filepath.SkipAll
 		}
 
-		progressInfo.CurrentFile = shortPath
+		progressInfo.SetCurrentFile(shortPath)
 		delete(removedPaths, shortPath)
 
-		file, exists := doc.Files[shortPath]
+		file, exists := pipeline.GetFile(shortPath)
 
 		archive := ArchiveInfo{
-			Document:  doc,
+			Chunks:    pipeline.Chunks,
+			Document:  pipeline.Document,
 			File:      file,
 			FileInfo:  fileInfo,
 			FileSize:  uint64(fileInfo.Size()),
@@ -319,44 +376,92 @@ func walkDirectoryFn(
 
 		// Fast path for directories as they do not need chunks and snapshots.
 		if fileInfo.IsDir() {
-			err := archiveFile(&archive, exists)
-			utils.PanicIfErr(err)
+			pipeline.AddDirectory(&archive, exists)
 			return nil
 		}
 
+		// Files with a stored hash are only chunked if their hash changed.
+		var verify bool
+
 		if exists {
-			if !fileHasChanged(&archive) {
+			changed := fileHasChanged(&archive)
+
+			// With --checksum, unchanged files from older indexes are
+			// hashed once so that their content can be verified on restore.
+			backfillHash := *archiveChecksum && len(file.Hash) == 0 && file.Size != 0
+
+			if !changed && trustMtime() && !backfillHash {
 				utils.Trace.Printf("skipping unchanged file %s", shortPath)
-				progressInfo.SkippedData += file.Size
-				progressInfo.SkippedFiles++
+				progressInfo.AddSkipped(file.Size)
 				return nil
 			}
 
-			utils.Trace.Printf("updating changed file %s", shortPath)
-			addToDeletedFiles(&archive)
+			verify = useChecksums() && file.Size == archive.FileSize && (len(file.Hash) != 0 || !changed && trustMtime())
+
+			if changed {
+				utils.Trace.Printf("updating changed file %s", shortPath)
+			} else if backfillHash && trustMtime() {
+				utils.Trace.Printf("hashing unchanged file %s", shortPath)
+			} else {
+				utils.Trace.Printf("checking content of file %s", shortPath)
+			}
 		} else {
 			utils.Trace.Printf("adding new file %s", shortPath)
 		}
 
-		err = archiveFile(&archive, exists)
+		pipeline.AddFile(archive, exists, verify)
+
+		return nil
+	})
+}
+
+// walkSourceFn returns a filepath.WalkFunc that calls fn for every path in
+// inputDir that is to be archived. The output directory, paths that match
+// excludes and, unless followSymlinks is set, symbolic links are skipped.
+func walkSourceFn(
+	inputDir string,
+	outputDir string,
+	excludes utils.Globfile,
+	followSymlinks bool,
+	fn func(fullPath string, shortPath string, fileInfo os.FileInfo) error,
+) filepath.WalkFunc {
+
+	inputDirLength := len(inputDir) + 1
+
+	return func(fullPath string, fileInfo os.FileInfo, err error) error {
+		fullPath = utils.FixSlashes(fullPath)
 
 		if err != nil {
-			utils.Error.Println(err)
+			utils.Error.Printf("error while walking %s: %s", fullPath, err)
 			return nil
 		}
 
-		progressInfo.ProcessedFiles++
-		progressInfo.ProcessedData += archive.FileSize
+		// Do not walk output directory.
+		if fileInfo.IsDir() && len(outputDir) != 0 && strings.HasPrefix(fullPath, outputDir) {
+			return filepath.SkipDir
+		}
+
+		if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink && !followSymlinks {
+			return filepath.SkipDir
+		}
+
+		var shortPath string
 
-		select {
-		case <-save:
-			utils.Info.Println("doing intermediary index save")
-			saveIndex(getIndexFilename(outputDir), doc)
-			utils.Info.Println("continuing archive process")
-		default:
+		if len(fullPath) >= inputDirLength {
+			shortPath = fullPath[inputDirLength:]
 		}
 
-		return nil
+		if excludes.Matches(shortPath) {
+			utils.Trace.Printf("skipping %s because path is in exclude file", shortPath)
+
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		return fn(fullPath, shortPath, fileInfo)
 	}
 }
 
@@ -368,8 +473,8 @@ func printProgress(
 	totalDuration time.Duration,
 ) {
 
-	processedDataFormatted := utils.FormatFileSize(progressInfo.ProcessedData)
-	skippedDataFormatted := utils.FormatFileSize(progressInfo.SkippedData)
+	processedDataFormatted := utils.FormatFileSize(atomic.LoadUint64(&progressInfo.ProcessedData))
+	skippedDataFormatted := utils.FormatFileSize(atomic.LoadUint64(&progressInfo.SkippedData))
 
 	transferRate := lastTickData / uint64(lastTickDuration.Seconds())
 	transferRateFormatted := utils.FormatFileSize(transferRate) + "/s"
@@ -387,11 +492,11 @@ File rate:       %d files/s
 
 `,
 		totalDuration,
-		progressInfo.ProcessedFiles,
+		atomic.LoadUint64(&progressInfo.ProcessedFiles),
 		processedDataFormatted,
-		progressInfo.SkippedFiles,
+		atomic.LoadUint64(&progressInfo.SkippedFiles),
 		skippedDataFormatted,
-		progressInfo.CurrentFile,
+		progressInfo.GetCurrentFile(),
 		transferRateFormatted,
 		fileRate,
 	)
@@ -399,8 +504,8 @@ File rate:       %d files/s
 
 func startProgressUpdater(progressInfo *ProgressInfo, done chan bool) {
 	go func() {
-		lastTotalProcessedData := progressInfo.ProcessedData
-		lastTotalProcessedFiles := progressInfo.ProcessedFiles
+		lastTotalProcessedData := atomic.LoadUint64(&progressInfo.ProcessedData)
+		lastTotalProcessedFiles := atomic.LoadUint64(&progressInfo.ProcessedFiles)
 		lastTick := time.Now()
 		start := time.Now()
 		ticker := time.NewTicker(progressUpdateInterval)
@@ -413,11 +518,13 @@ func startProgressUpdater(progressInfo *ProgressInfo, done chan bool) {
 				lastTickDuration := now.Sub(lastTick)
 				lastTick = now
 
-				lastTickData := progressInfo.ProcessedData - lastTotalProcessedData
-				lastTotalProcessedData = progressInfo.ProcessedData
+				processedData := atomic.LoadUint64(&progressInfo.ProcessedData)
+				lastTickData := processedData - lastTotalProcessedData
+				lastTotalProcessedData = processedData
 
-				lastTickFiles := progressInfo.ProcessedFiles - lastTotalProcessedFiles
-				lastTotalProcessedFiles = progressInfo.ProcessedFiles
+				processedFiles := atomic.LoadUint64(&progressInfo.ProcessedFiles)
+				lastTickFiles := processedFiles - lastTotalProcessedFiles
+				lastTotalProcessedFiles = processedFiles
 
 				totalDuration := now.Sub(start)
 				totalDuration = time.Duration(totalDuration.Seconds()) * time.Second
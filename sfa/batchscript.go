@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/srhnsn/securefilearchiver/models"
+)
+
+const (
+	batchGnupgBinary    = "gpg2"
+	batchMaxLineLength  = 8191
+	batchScriptFilename = "restore.bat"
+	// batchUnsafeChars are characters that cannot be used in paths in batch
+	// files: ^ is doubled by call even in quotes, * and ? are wildcards and
+	// the others are not allowed in Windows filenames. ! is safe because the
+	// script disables delayed expansion.
+	batchUnsafeChars = `"*:<>?\^|`
+	mtimeFormat      = "2006-01-02 15:04:05.999999999 -0700"
+)
+
+// batchScript generates Windows batch files.
+type batchScript struct{}
+
+func (batchScript) Filename() string {
+	return batchScriptFilename
+}
+
+func (batchScript) Header() []string {
+	return []string{
+		"@echo off",
+		"setlocal DisableDelayedExpansion",
+		"",
+		"chcp 65001 >NUL",
+		"set mismatches=0",
+		"",
+	}
+}
+
+// Footer returns the end of the restore script: a summary of files that do
+// not match their checksums and the subroutine that is called for each of
+// these files.
+func (batchScript) Footer() []string {
+	return []string{
+		"if %mismatches% gtr 0 (",
+		"    echo.",
+		"    echo ************************************************************",
+		"    echo %mismatches% restored files do not match their checksums!",
+		"    echo ************************************************************",
+		")",
+		"",
+		"pause",
+		"goto :eof",
+		"",
+		":mismatch",
+		"echo.",
+		"echo ************************************************************",
+		"echo CHECKSUM MISMATCH: %1",
+		"echo ************************************************************",
+		"set /a mismatches+=1",
+		"goto :eof",
+	}
+}
+
+func (batchScript) LineEnding() string {
+	return "\r\n"
+}
+
+// Concat returns the commands that concatenate files to dest. If the command
+// line would be too long for cmd.exe, the remaining files are appended to dest
+// by further copy commands without a destination, which append to the first
+// file.
+func (script batchScript) Concat(files []string, dest string) string {
+	if len(files) == 0 {
+		return fmt.Sprintf(`type NUL > %s`, batchQuote(dest))
+	}
+
+	cmds := []string{}
+	target := " " + batchQuote(dest)
+	sources := []string{}
+	length := len(target)
+
+	for _, file := range files {
+		quoted := batchQuote(file)
+
+		if len(sources) > 1 && length+len(quoted) > batchMaxLineLength-32 {
+			cmds = append(cmds, fmt.Sprintf(`copy /B /Y %s%s >NUL`, strings.Join(sources, "+"), target))
+			target = ""
+			sources = []string{batchQuote(dest)}
+			length = len(sources[0])
+		}
+
+		sources = append(sources, quoted)
+		length += len(quoted) + 1
+	}
+
+	cmds = append(cmds, fmt.Sprintf(`copy /B /Y %s%s >NUL`, strings.Join(sources, "+"), target))
+
+	return strings.Join(cmds, script.LineEnding())
+}
+
+// Decompress returns a command that decompresses path and removes it. The
+// decompressed file is path without the compression suffix.
+func (batchScript) Decompress(compression string, path string) string {
+	if compression == models.CompressionZstd {
+		return fmt.Sprintf(`call zstd --decompress --quiet --force --rm %s`, batchCallQuote(path))
+	}
+
+	return fmt.Sprintf(`call gzip --decompress --force %s`, batchCallQuote(path))
+}
+
+// Decrypt returns a command that decrypts the chunk in source to dest.
+func (batchScript) Decrypt(chunk models.Chunk, source string, dest string) string {
+	if chunk.Encryption == models.EncryptionHKDF {
+		return fmt.Sprintf(`call sfa decrypt-chunk --key-file %s %s %s`,
+			batchCallQuote(passwordFile), batchCallQuote(source), batchCallQuote(dest))
+	}
+
+	return fmt.Sprintf(`call %s --batch --decrypt --passphrase-file %s --quiet --output %s %s`,
+		batchGnupgBinary, batchCallQuote(passwordFile), batchCallQuote(dest), batchCallQuote(source))
+}
+
+func (batchScript) Delete(path string) string {
+	return fmt.Sprintf(`del %s`, batchQuote(path))
+}
+
+// Extract returns a command that copies length bytes at offset in the file
+// source to dest. There is no standard Windows console command for this, so
+// PowerShell is used.
+func (batchScript) Extract(source string, offset uint64, length uint64, dest string) string {
+	return fmt.Sprintf(
+		`powershell -NoProfile -Command "$in = [IO.File]::OpenRead(%s); $in.Position = %d; `+
+			`$data = New-Object byte[] %d; $n = 0; while ($n -lt %d) { $r = $in.Read($data, $n, %d - $n); if ($r -le 0) { exit 1 }; $n += $r }; `+
+			`$in.Close(); [IO.File]::WriteAllBytes(%s, $data)"`,
+		batchEscape(powerShellQuote(source)),
+		offset,
+		length,
+		length,
+		length,
+		batchEscape(powerShellQuote(dest)),
+	)
+}
+
+func (batchScript) MkDir(dir string) string {
+	return fmt.Sprintf(`mkdir %s >NUL 2>&1`, batchQuote(dir))
+}
+
+func (batchScript) Progress(current uint64, total uint64, path string) string {
+	return fmt.Sprintf(`echo [%d/%d] %s`, current, total, batchQuote(path))
+}
+
+func (batchScript) Touch(path string, mtime time.Time) string {
+	return fmt.Sprintf(
+		`call touch -d "%s" %s`,
+		mtime.Format(mtimeFormat),
+		batchCallQuote(path),
+	)
+}
+
+// Verify returns a command that compares the SHA-256 checksum of path with
+// hash and reports a mismatch.
+func (batchScript) Verify(path string, hash string) string {
+	return fmt.Sprintf(
+		`certutil -hashfile %s SHA256 | findstr /i /x /c:"%s" >NUL || call :mismatch %s`,
+		batchQuote(path),
+		hash,
+		batchCallQuote(path),
+	)
+}
+
+// CheckPath returns an error if path contains characters that cannot be
+// quoted safely in a batch file or if the commands for path would exceed the
+// maximum command line length of cmd.exe.
+func (script batchScript) CheckPath(path string) error {
+	if !utf8.ValidString(path) {
+		return fmt.Errorf("path is not valid UTF-8")
+	}
+
+	for _, r := range path {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("path contains the control character %U", r)
+		}
+
+		if strings.ContainsRune(batchUnsafeChars, r) {
+			return fmt.Errorf("path contains %q, which cannot be used in a batch file", r)
+		}
+	}
+
+	if len(script.Verify(path, strings.Repeat("0", 64))) > batchMaxLineLength {
+		return fmt.Errorf("path is too long for a batch file")
+	}
+
+	return nil
+}
+
+// batchEscape escapes the percent signs in s, which are expanded by cmd.exe
+// even in quotes. All other special characters are literal in quotes.
+func batchEscape(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// batchQuote quotes path for commands in a batch file. The path must have
+// been checked with CheckPath.
+func batchQuote(path string) string {
+	return `"` + batchEscape(path) + `"`
+}
+
+// batchCallQuote quotes path for commands that are run with call, which expands
+// percent signs a second time.
+func batchCallQuote(path string) string {
+	return `"` + batchEscape(batchEscape(path)) + `"`
+}
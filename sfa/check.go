@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/srhnsn/securefilearchiver/backend"
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const (
+	chunkOK = iota
+	chunkMissing
+	chunkCorrupt
+	chunkUnhashed
+)
+
+// Exit codes of check. Other errors exit with 1 (or 2 for panics).
+const (
+	checkExitMissing           = 3
+	checkExitCorrupt           = 4
+	checkExitMissingAndCorrupt = 5
+)
+
+// CheckInfo holds the results of an archive check.
+type CheckInfo struct {
+	Chunks        uint64
+	Data          uint64
+	Missing       uint64
+	Corrupt       uint64
+	Unhashed      uint64
+	AffectedFiles uint64
+}
+
+// ChunksByLocation sorts chunks by the file they are stored in and their
+// offset in pack files.
+type ChunksByLocation []models.Chunk
+
+func (chunks ChunksByLocation) Len() int {
+	return len(chunks)
+}
+
+func (chunks ChunksByLocation) Less(i, j int) bool {
+	if chunks[i].Pack != chunks[j].Pack {
+		return chunks[i].Pack < chunks[j].Pack
+	}
+
+	if chunks[i].Offset != chunks[j].Offset {
+		return chunks[i].Offset < chunks[j].Offset
+	}
+
+	return chunks[i].Name < chunks[j].Name
+}
+
+func (chunks ChunksByLocation) Swap(i, j int) {
+	chunks[i], chunks[j] = chunks[j], chunks[i]
+}
+
+type checkJob struct {
+	chunk  models.Chunk
+	status int
+}
+
+// checkArchive verifies all chunks that are referenced by the current and the
+// old versions of the files in the archive in inputDir. Every chunk is read,
+// decrypted and compared with its name and size. The file versions that use
+// missing or corrupt chunks are reported. With subset, only some chunks are
+// checked (see CheckSubset). The time of each successful verification is
+// stored in a sidecar file.
+//
+// With ciphertextOnly, the chunks in the manifest are only compared with the
+// hash sums of their encrypted data. This needs neither the index nor the
+// password, but cannot tell which files are affected. The manifest is read from
+// manifestPath if it is not empty.
+func checkArchive(inputDir string, jobs int, subsetStr string, ciphertextOnly bool, manifestPath string) {
+	var subset *CheckSubset
+	var doc *models.Document
+	var allChunks ChunksByLocation
+	var check func(chunk models.Chunk) int
+	var err error
+
+	if len(subsetStr) != 0 {
+		subset, err = parseCheckSubset(subsetStr)
+
+		utils.PanicIfErr(err)
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	if ciphertextOnly {
+		allChunks, err = readManifest(inputDir, manifestPath)
+
+		utils.PanicIfErr(err)
+
+		check = func(chunk models.Chunk) int {
+			return checkChunkCiphertext(inputDir, chunk)
+		}
+	} else {
+		if !archiveFileExists(inputDir, getExistingIndexFilename(inputDir)) {
+			utils.PanicIfErr(fmt.Errorf("no index found in %s", backend.Redact(inputDir)))
+		}
+
+		doc, err = readIndex(inputDir)
+
+		utils.PanicIfErr(err)
+
+		allChunks = getCheckChunks(doc)
+		chunkNameMatches := getChunkNameChecker(doc)
+
+		if len(doc.UnmigratedChunks) != 0 {
+			utils.Info.Printf("%d chunks still have plain SHA-256 names, run index --migrate-chunk-names to rename them", len(doc.UnmigratedChunks))
+		}
+
+		check = func(chunk models.Chunk) int {
+			return checkChunk(inputDir, chunk, doc.KeyUnencrypted, chunkNameMatches)
+		}
+	}
+
+	verified := readVerifiedChunks(inputDir)
+	chunks := allChunks
+
+	oldest, never := getOldestVerification(allChunks, verified)
+
+	if never != 0 {
+		utils.Info.Printf("%d of %d chunks were never verified", never, len(allChunks))
+	} else if !oldest.IsZero() {
+		utils.Info.Printf("all chunks were verified since %s", oldest.Local().Format(displayTimeFormat))
+	}
+
+	if subset != nil {
+		chunks = selectCheckChunks(allChunks, subset, verified)
+		utils.Info.Printf("checking %d of %d chunks (%s)", len(chunks), len(allChunks), subsetStr)
+	}
+
+	results := checkChunks(chunks, jobs, check)
+
+	// Only decrypted chunks count as verified.
+	if !ciphertextOnly {
+		updateVerifiedChunks(inputDir, verified, allChunks, results)
+	}
+
+	info := CheckInfo{
+		Chunks: uint64(len(chunks)),
+	}
+
+	for _, chunk := range chunks {
+		info.Data += chunk.Size
+
+		switch results[getChunkLocation(chunk)] {
+		case chunkMissing:
+			info.Missing++
+		case chunkCorrupt:
+			info.Corrupt++
+		case chunkUnhashed:
+			info.Unhashed++
+		}
+	}
+
+	if doc != nil && (info.Missing != 0 || info.Corrupt != 0) {
+		info.AffectedFiles = printAffectedFiles(doc, results)
+	}
+
+	printCheckInfo(info, doc != nil)
+	closeBackends()
+
+	switch {
+	case info.Missing != 0 && info.Corrupt != 0:
+		os.Exit(checkExitMissingAndCorrupt)
+	case info.Missing != 0:
+		os.Exit(checkExitMissing)
+	case info.Corrupt != 0:
+		os.Exit(checkExitCorrupt)
+	}
+}
+
+// getCheckChunks returns every stored chunk of doc once, sorted by location
+// so that pack files are read sequentially.
+func getCheckChunks(doc *models.Document) ChunksByLocation {
+	unique := map[string]models.Chunk{}
+
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		unique[getChunkLocation(*chunk)] = *chunk
+	})
+
+	chunks := ChunksByLocation{}
+
+	for _, chunk := range unique {
+		chunks = append(chunks, chunk)
+	}
+
+	sort.Sort(chunks)
+
+	return chunks
+}
+
+// checkChunks checks chunks with check in jobs concurrent workers and returns
+// the status of each chunk by location (see getChunkLocation), as chunks from
+// the manifest may have no name.
+func checkChunks(chunks ChunksByLocation, jobs int, check func(chunk models.Chunk) int) map[string]int {
+	queue := make(chan *checkJob, jobs)
+	checked := make(chan *checkJob, jobs)
+
+	startWorkers(jobs, func() {
+		for job := range queue {
+			job.status = check(job.chunk)
+			checked <- job
+		}
+	}, func() { close(checked) })
+
+	go func() {
+		for _, chunk := range chunks {
+			queue <- &checkJob{chunk: chunk}
+		}
+
+		close(queue)
+	}()
+
+	results := map[string]int{}
+	progress := 0
+
+	for job := range checked {
+		results[getChunkLocation(job.chunk)] = job.status
+		progress++
+
+		if progress%1000 == 0 {
+			utils.Info.Printf("checked %d of %d chunks", progress, len(chunks))
+		}
+	}
+
+	return results
+}
+
+// checkChunk reads and decrypts chunk and compares its content with the chunk
+// name and size, and the encrypted data with the ciphertext hash if there is
+// one. Problems are logged.
+func checkChunk(inputDir string, chunk models.Chunk, key string, chunkNameMatches chunkNameChecker) int {
+	err := checkChunkExists(inputDir, chunk)
+
+	if err != nil {
+		utils.Error.Printf("chunk %s is missing: %s", chunk.Name, err)
+		return chunkMissing
+	}
+
+	ciphertext, err := readChunk(inputDir, chunk)
+
+	if err != nil {
+		utils.Error.Printf("cannot read chunk %s: %s", chunk.Name, err)
+		return chunkCorrupt
+	}
+
+	if len(chunk.CiphertextHash) != 0 && utils.GetHashSum(ciphertext) != chunk.CiphertextHash {
+		utils.Error.Printf("chunk %s is corrupt: its encrypted data does not match its ciphertext hash", chunk.Name)
+		return chunkCorrupt
+	}
+
+	data, err := decryptChunk(ciphertext, chunk, key)
+
+	if err != nil {
+		utils.Error.Printf("chunk %s is corrupt: %s", chunk.Name, err)
+		return chunkCorrupt
+	}
+
+	if uint64(len(data)) != chunk.Size {
+		utils.Error.Printf("chunk %s is corrupt: expected %d bytes, got %d", chunk.Name, chunk.Size, len(data))
+		return chunkCorrupt
+	}
+
+	if !chunkNameMatches(data, chunk.Name) {
+		utils.Error.Printf("chunk %s is corrupt: its content does not match its name", chunk.Name)
+		return chunkCorrupt
+	}
+
+	utils.Trace.Printf("chunk %s is fine", chunk.Name)
+
+	return chunkOK
+}
+
+// checkChunkCiphertext compares the SHA-256 sum of the encrypted data of chunk
+// with the hash sum in the manifest. Chunks without hash sum are only checked
+// for existence. Problems are logged.
+func checkChunkCiphertext(inputDir string, chunk models.Chunk) int {
+	location := getChunkLocation(chunk)
+	err := checkChunkExists(inputDir, chunk)
+
+	if err != nil {
+		utils.Error.Printf("chunk %s is missing: %s", location, err)
+		return chunkMissing
+	}
+
+	if len(chunk.CiphertextHash) == 0 {
+		utils.Trace.Printf("chunk %s has no ciphertext hash", location)
+		return chunkUnhashed
+	}
+
+	ciphertext, err := readChunk(inputDir, chunk)
+
+	if err != nil {
+		utils.Error.Printf("cannot read chunk %s: %s", location, err)
+		return chunkCorrupt
+	}
+
+	if hash := utils.GetHashSum(ciphertext); hash != chunk.CiphertextHash {
+		utils.Error.Printf("chunk %s is corrupt: expected ciphertext hash %s, got %s", location, chunk.CiphertextHash, hash)
+		return chunkCorrupt
+	}
+
+	utils.Trace.Printf("chunk %s is fine", location)
+
+	return chunkOK
+}
+
+// checkChunkExists returns an error if the file of chunk does not exist or, if
+// the chunk is stored in a pack, the pack is too short to contain it.
+func checkChunkExists(inputDir string, chunk models.Chunk) error {
+	fileInfo, err := getBackend(inputDir).Stat(getStoredFilename(chunk))
+
+	if err != nil || len(chunk.Pack) == 0 {
+		return err
+	}
+
+	if fileInfo.Size < chunk.Offset+chunk.Length {
+		return fmt.Errorf("pack %s is truncated", chunk.Pack)
+	}
+
+	return nil
+}
+
+// printAffectedFiles prints every file version that uses chunks that are not
+// fine according to results and returns the number of these versions. Version
+// numbers are those of the versions command.
+func printAffectedFiles(doc *models.Document, results map[string]int) uint64 {
+	paths := map[string]bool{}
+
+	for shortPath := range doc.Files {
+		paths[shortPath] = true
+	}
+
+	for shortPath := range doc.DeletedFiles {
+		paths[shortPath] = true
+	}
+
+	sortedPaths := []string{}
+
+	for shortPath := range paths {
+		sortedPaths = append(sortedPaths, shortPath)
+	}
+
+	sort.Strings(sortedPaths)
+
+	var affected uint64
+
+	for _, shortPath := range sortedPaths {
+		versions := doc.GetFileVersions(shortPath)
+
+		for i, file := range versions {
+			var missing, corrupt int
+
+			for _, chunk := range file.Chunks {
+				switch results[getChunkLocation(chunk)] {
+				case chunkMissing:
+					missing++
+				case chunkCorrupt:
+					corrupt++
+				}
+			}
+
+			if missing == 0 && corrupt == 0 {
+				continue
+			}
+
+			state := "current"
+
+			if file.DeletedAt != nil {
+				state = "deleted " + file.DeletedAt.Local().Format(displayTimeFormat)
+			}
+
+			affected++
+			fmt.Printf("%s (version %d, %s): %d missing, %d corrupt chunks\n",
+				shortPath, i+1, state, missing, corrupt)
+		}
+	}
+
+	return affected
+}
+
+func printCheckInfo(info CheckInfo, withFiles bool) {
+	// Chunk sizes are not in the manifest.
+	if info.Data != 0 {
+		utils.Info.Printf("checked %d chunks (%s)", info.Chunks, utils.FormatFileSize(info.Data))
+	} else {
+		utils.Info.Printf("checked %d chunks", info.Chunks)
+	}
+
+	if info.Unhashed != 0 {
+		utils.Info.Printf("%d chunks have no ciphertext hash and were only checked for existence, run index --hash-ciphertexts to add them", info.Unhashed)
+	}
+
+	if info.Missing == 0 && info.Corrupt == 0 {
+		utils.Info.Println("no errors found")
+		return
+	}
+
+	if !withFiles {
+		utils.Error.Printf("%d missing and %d corrupt chunks", info.Missing, info.Corrupt)
+		return
+	}
+
+	utils.Error.Printf("%d missing and %d corrupt chunks, %d file versions are affected",
+		info.Missing, info.Corrupt, info.AffectedFiles)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// verifiedFilename is the sidecar file in the archive directory that stores
+// when each chunk was last verified. It is not part of the index, so that
+// checks never rewrite the index. It is not encrypted and therefore does not
+// contain chunk names.
+const verifiedFilename = "verified.json"
+
+// VerifiedChunks maps chunk locations (see getChunkLocation) to the time they
+// were last verified successfully. Chunks that are moved to another pack are
+// verified again.
+type VerifiedChunks map[string]models.JSONTime
+
+// CheckSubset selects the chunks that are checked. Either Percent of all
+// chunks are checked, those that were not verified for the longest time first,
+// or slice Slice of Slices, which is selected by the chunk locations.
+type CheckSubset struct {
+	Percent float64
+	Slice   uint64
+	Slices  uint64
+}
+
+// parseCheckSubset parses --read-data-subset, either a percentage like "5%"
+// or a slice like "2/7".
+func parseCheckSubset(input string) (*CheckSubset, error) {
+	if strings.HasSuffix(input, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(input, "%"), 64)
+
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percentage %s, must be greater than 0%% and at most 100%%", input)
+		}
+
+		return &CheckSubset{Percent: percent}, nil
+	}
+
+	parts := strings.Split(input, "/")
+
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid subset %s, must be a percentage like 5%% or a slice like 1/10", input)
+	}
+
+	slice, err := strconv.ParseUint(parts[0], 10, 64)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid slice number %s", parts[0])
+	}
+
+	slices, err := strconv.ParseUint(parts[1], 10, 64)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid slice count %s", parts[1])
+	}
+
+	if slice < 1 || slice > slices {
+		return nil, fmt.Errorf("invalid subset %s, the slice number must be between 1 and %d", input, slices)
+	}
+
+	return &CheckSubset{Slice: slice, Slices: slices}, nil
+}
+
+// selectCheckChunks returns the chunks in subset, sorted by location.
+func selectCheckChunks(chunks ChunksByLocation, subset *CheckSubset, verified VerifiedChunks) ChunksByLocation {
+	selected := ChunksByLocation{}
+
+	if subset.Slices != 0 {
+		for _, chunk := range chunks {
+			if getChunkSlice(chunk, subset.Slices) == subset.Slice {
+				selected = append(selected, chunk)
+			}
+		}
+
+		return selected
+	}
+
+	count := int(math.Ceil(float64(len(chunks)) * subset.Percent / 100))
+
+	// Shuffle first, so that chunks that were verified at the same time (or
+	// never) are selected randomly.
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, i := range random.Perm(len(chunks)) {
+		selected = append(selected, chunks[i])
+	}
+
+	sort.Stable(chunksByVerification{chunks: selected, verified: verified})
+
+	selected = selected[:count]
+	sort.Sort(selected)
+
+	return selected
+}
+
+// getChunkSlice returns the slice number (starting at 1) of chunk when all
+// chunks are split into slices slices. The slice is taken from the hash sum of
+// the chunk location, so the slices are about equally large and the same
+// without the index.
+func getChunkSlice(chunk models.Chunk, slices uint64) uint64 {
+	prefix := utils.GetHashSum([]byte(getChunkLocation(chunk)))
+
+	if len(prefix) > 15 {
+		prefix = prefix[:15]
+	}
+
+	value, err := strconv.ParseUint(prefix, 16, 64)
+
+	utils.PanicIfErr(err)
+
+	return value%slices + 1
+}
+
+// chunksByVerification sorts chunks by the time they were last verified,
+// chunks that were never verified first.
+type chunksByVerification struct {
+	chunks   ChunksByLocation
+	verified VerifiedChunks
+}
+
+func (sorter chunksByVerification) Len() int {
+	return len(sorter.chunks)
+}
+
+func (sorter chunksByVerification) Less(i, j int) bool {
+	return sorter.verified[getChunkLocation(sorter.chunks[i])].Before(sorter.verified[getChunkLocation(sorter.chunks[j])].Time)
+}
+
+func (sorter chunksByVerification) Swap(i, j int) {
+	sorter.chunks.Swap(i, j)
+}
+
+// readVerifiedChunks reads the verification times of the archive in inputDir.
+func readVerifiedChunks(inputDir string) VerifiedChunks {
+	verified := VerifiedChunks{}
+	data, err := getBackend(inputDir).Get(verifiedFilename)
+
+	if os.IsNotExist(err) {
+		return verified
+	}
+
+	utils.PanicIfErr(err)
+
+	err = json.Unmarshal(data, &verified)
+
+	utils.PanicIfErr(err)
+
+	return verified
+}
+
+// updateVerifiedChunks stores the time of the chunks that were checked
+// successfully according to results. Chunks that are missing, corrupt or no
+// longer in the index are removed.
+func updateVerifiedChunks(inputDir string, verified VerifiedChunks, chunks ChunksByLocation, results map[string]int) {
+	if *dryRun {
+		utils.Info.Println("dry run, not writing verification times")
+		return
+	}
+
+	now := models.JSONTime{Time: time.Now()}
+	updated := VerifiedChunks{}
+
+	for _, chunk := range chunks {
+		location := getChunkLocation(chunk)
+		status, checked := results[location]
+
+		if !checked {
+			if verifiedAt, exists := verified[location]; exists {
+				updated[location] = verifiedAt
+			}
+		} else if status == chunkOK {
+			updated[location] = now
+		}
+	}
+
+	data, err := json.Marshal(updated)
+
+	utils.PanicIfErr(err)
+
+	err = putWithRetry(inputDir, verifiedFilename, data)
+
+	utils.PanicIfErr(err)
+}
+
+// getOldestVerification returns the oldest verification time of chunks and
+// the number of chunks that were never verified.
+func getOldestVerification(chunks ChunksByLocation, verified VerifiedChunks) (time.Time, uint64) {
+	var oldest time.Time
+	var never uint64
+
+	for _, chunk := range chunks {
+		verifiedAt, exists := verified[getChunkLocation(chunk)]
+
+		if !exists {
+			never++
+			continue
+		}
+
+		if oldest.IsZero() || verifiedAt.Before(oldest) {
+			oldest = verifiedAt.Time
+		}
+	}
+
+	return oldest, never
+}
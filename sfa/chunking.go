@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const (
+	defaultChunkMinSize = 256 * 1024
+	defaultChunkAvgSize = 1024 * 1024
+	defaultChunkMaxSize = 4 * 1024 * 1024
+	legacyChunkSize     = 1024 * 1024
+)
+
+// sizeAwareChunkScales maps file sizes to the factor by which the configured
+// chunk sizes are multiplied with the size-aware chunk policy. Files that are
+// larger than all listed sizes use maxChunkScale.
+var sizeAwareChunkScales = []struct {
+	fileSize uint64
+	scale    uint64
+}{
+	{64 * 1024 * 1024, 1},
+	{1024 * 1024 * 1024, 2},
+	{16 * 1024 * 1024 * 1024, 4},
+}
+
+// maxChunkScale is kept small because the content-defined chunker buffers up
+// to the scaled maximum chunk size for every file that is read concurrently.
+const maxChunkScale = 8
+
+// applyChunkingFlags stores the chunking configuration from the command line
+// in doc. Settings that were not specified are taken from the index.
+func applyChunkingFlags(doc *models.Document) {
+	oldChunking := getChunking(doc)
+	chunking := oldChunking
+
+	if len(*archiveChunking) != 0 {
+		chunking.Mode = *archiveChunking
+	}
+
+	if len(*archiveChunkPolicy) != 0 {
+		chunking.Policy = *archiveChunkPolicy
+	}
+
+	if *archiveChunkAvg != 0 {
+		chunking.AvgSize = uint64(*archiveChunkAvg)
+		chunking.MinSize = 0
+		chunking.MaxSize = 0
+	}
+
+	if *archiveChunkMin != 0 {
+		chunking.MinSize = uint64(*archiveChunkMin)
+	}
+
+	if *archiveChunkMax != 0 {
+		chunking.MaxSize = uint64(*archiveChunkMax)
+	}
+
+	if chunking.Mode == models.ChunkingFixed {
+		chunking.MinSize = 0
+		chunking.MaxSize = 0
+	} else {
+		if chunking.MinSize == 0 {
+			chunking.MinSize = chunking.AvgSize / 4
+		}
+
+		if chunking.MaxSize == 0 {
+			chunking.MaxSize = chunking.AvgSize * 4
+		}
+	}
+
+	err := validateChunking(chunking)
+
+	utils.PanicIfErr(err)
+
+	if chunking != oldChunking {
+		utils.Info.Printf("changing chunking from %s to %s, changed files will be chunked with the new settings",
+			formatChunking(oldChunking), formatChunking(chunking))
+	}
+
+	doc.Chunking = &chunking
+}
+
+func formatChunking(chunking models.Chunking) string {
+	var sizes string
+
+	if chunking.Mode == models.ChunkingFixed {
+		sizes = utils.FormatFileSize(chunking.AvgSize)
+	} else {
+		sizes = fmt.Sprintf("min %s, avg %s, max %s",
+			utils.FormatFileSize(chunking.MinSize),
+			utils.FormatFileSize(chunking.AvgSize),
+			utils.FormatFileSize(chunking.MaxSize),
+		)
+	}
+
+	if chunking.Policy == models.ChunkPolicySizeAware {
+		sizes += ", scaled up for large files"
+	}
+
+	return fmt.Sprintf("%s (%s)", chunking.Mode, sizes)
+}
+
+// getChunking returns the chunking configuration of doc. Indexes that were
+// created before chunking was configurable used fixed 1 MiB chunks.
+func getChunking(doc *models.Document) models.Chunking {
+	if doc.Chunking == nil {
+		return models.Chunking{
+			Mode:    models.ChunkingFixed,
+			AvgSize: legacyChunkSize,
+		}
+	}
+
+	return *doc.Chunking
+}
+
+func getDefaultChunking() *models.Chunking {
+	return &models.Chunking{
+		Mode:    models.ChunkingContentDefined,
+		MinSize: defaultChunkMinSize,
+		AvgSize: defaultChunkAvgSize,
+		MaxSize: defaultChunkMaxSize,
+		Policy:  models.ChunkPolicySizeAware,
+	}
+}
+
+// getFileChunking returns the chunking configuration that is used for a file
+// of the given size. With the size-aware policy, large files get larger chunks
+// so they do not turn into an excessive number of chunk files.
+func getFileChunking(size uint64, chunking models.Chunking) models.Chunking {
+	if chunking.Policy != models.ChunkPolicySizeAware {
+		return chunking
+	}
+
+	scale := uint64(maxChunkScale)
+
+	for _, tier := range sizeAwareChunkScales {
+		if size < tier.fileSize {
+			scale = tier.scale
+			break
+		}
+	}
+
+	chunking.MinSize *= scale
+	chunking.AvgSize *= scale
+	chunking.MaxSize *= scale
+
+	return chunking
+}
+
+func newChunker(reader io.Reader, size uint64, chunking models.Chunking) utils.Chunker {
+	chunking = getFileChunking(size, chunking)
+
+	if chunking.Mode == models.ChunkingFixed {
+		return utils.NewFixedChunker(reader, chunking.AvgSize)
+	}
+
+	return utils.NewContentDefinedChunker(reader, chunking.MinSize, chunking.AvgSize, chunking.MaxSize)
+}
+
+func validateChunking(chunking models.Chunking) error {
+	switch chunking.Mode {
+	case models.ChunkingFixed:
+		if chunking.AvgSize == 0 {
+			return fmt.Errorf("chunk size must not be 0")
+		}
+
+	case models.ChunkingContentDefined:
+		if chunking.MinSize == 0 || chunking.MinSize >= chunking.AvgSize || chunking.AvgSize >= chunking.MaxSize {
+			return fmt.Errorf("chunk sizes must satisfy 0 < min (%d) < avg (%d) < max (%d)",
+				chunking.MinSize, chunking.AvgSize, chunking.MaxSize)
+		}
+
+	default:
+		return fmt.Errorf("unknown chunking mode: %s", chunking.Mode)
+	}
+
+	switch chunking.Policy {
+	case "", models.ChunkPolicyConstant, models.ChunkPolicySizeAware:
+	default:
+		return fmt.Errorf("unknown chunk policy: %s", chunking.Policy)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// chunkNamer returns the name of the chunk with the plaintext data.
+type chunkNamer func(data []byte) string
+
+// getChunkNamer returns the chunk naming function of doc. Archives that were
+// created before keyed chunk names existed keep using plain SHA-256 sums until
+// they are migrated, so that their chunks are still deduplicated.
+func getChunkNamer(doc *models.Document) chunkNamer {
+	if doc.ChunkNames != models.ChunkNamesHMAC {
+		return utils.GetHashSum
+	}
+
+	key := utils.DeriveChunkNameKey(doc.KeyUnencrypted)
+
+	return func(data []byte) string {
+		return utils.GetKeyedHashSum(data, key)
+	}
+}
+
+// chunkNameChecker reports whether name is the name of the chunk with the
+// plaintext data.
+type chunkNameChecker func(data []byte, name string) bool
+
+// getChunkNameChecker returns the chunk name check of doc. Plain SHA-256 names
+// are only accepted for archives that were not migrated to keyed names and
+// for the chunks whose migration failed.
+func getChunkNameChecker(doc *models.Document) chunkNameChecker {
+	chunkName := getChunkNamer(doc)
+	unmigrated := getUnmigratedChunks(doc)
+
+	return func(data []byte, name string) bool {
+		if unmigrated[name] {
+			return utils.GetHashSum(data) == name
+		}
+
+		return chunkName(data) == name
+	}
+}
+
+func getUnmigratedChunks(doc *models.Document) map[string]bool {
+	unmigrated := map[string]bool{}
+
+	for _, name := range doc.UnmigratedChunks {
+		unmigrated[name] = true
+	}
+
+	return unmigrated
+}
+
+// migrateChunkNames renames all chunks of the archive in inputDir from plain
+// SHA-256 sums to keyed names. Every chunk has to be decrypted to compute its
+// new name. Chunk files are copied to their new names before the index is
+// rewritten; the files with the old names are then unused and can be removed
+// with the garbage collection. Chunks that cannot be renamed keep their old
+// names and are stored in UnmigratedChunks of the index, so that running the
+// migration again only retries them.
+func migrateChunkNames(inputDir string) {
+	doc, err := readIndex(inputDir)
+
+	utils.PanicIfErr(err)
+
+	migrateAll := doc.ChunkNames != models.ChunkNamesHMAC
+	unmigrated := getUnmigratedChunks(doc)
+
+	if !migrateAll {
+		if len(unmigrated) == 0 {
+			utils.Info.Println("chunk names are already keyed")
+			return
+		}
+
+		utils.Info.Printf("retrying %d chunks that could not be renamed before", len(unmigrated))
+	}
+
+	doc.ChunkNames = models.ChunkNamesHMAC
+	chunkName := getChunkNamer(doc)
+	names := map[string]string{}
+	failed := map[string]bool{}
+
+	var renamed uint64
+
+	utils.Info.Println("renaming chunks")
+
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		if !migrateAll && !unmigrated[chunk.Name] {
+			return
+		}
+
+		name, exists := names[chunk.Name]
+
+		if !exists {
+			name = migrateChunkName(inputDir, doc, *chunk, chunkName)
+
+			if len(name) == 0 {
+				failed[chunk.Name] = true
+				name = chunk.Name
+			} else {
+				renamed++
+			}
+
+			names[chunk.Name] = name
+		}
+
+		chunk.Name = name
+	})
+
+	doc.UnmigratedChunks = []string{}
+
+	for name := range failed {
+		doc.UnmigratedChunks = append(doc.UnmigratedChunks, name)
+	}
+
+	sort.Strings(doc.UnmigratedChunks)
+
+	saveIndex(inputDir, doc)
+
+	utils.Info.Printf("renamed %d chunks, run index --gc to remove the chunk files with the old names", renamed)
+
+	if len(failed) > 0 {
+		utils.Error.Printf("%d chunks could not be renamed and keep their old names, run index --migrate-chunk-names again to retry them", len(failed))
+	}
+}
+
+// migrateChunkName computes the keyed name of chunk and, if the chunk is
+// stored in its own file, copies it to the new name. Chunks in pack files are
+// only renamed in the index. It returns an empty string if the chunk cannot be
+// read or does not match its old name.
+func migrateChunkName(inputDir string, doc *models.Document, chunk models.Chunk, chunkName chunkNamer) string {
+	ciphertext, err := readChunk(inputDir, chunk)
+
+	if err != nil {
+		utils.Error.Printf("cannot read chunk %s: %s", chunk.Name, err)
+		return ""
+	}
+
+	data, err := decryptChunk(ciphertext, chunk, doc.KeyUnencrypted)
+
+	if err != nil {
+		utils.Error.Println(err)
+		return ""
+	}
+
+	if utils.GetHashSum(data) != chunk.Name {
+		utils.Error.Printf("chunk %s is corrupt, its content does not match its name", chunk.Name)
+		return ""
+	}
+
+	name := chunkName(data)
+
+	if len(chunk.Pack) == 0 {
+		utils.Trace.Printf("renaming chunk %s to %s", chunk.Name, name)
+		err = saveChunk(inputDir, name+EncSuffix, ciphertext, writeRetries)
+
+		if err != nil {
+			utils.Error.Printf("cannot write chunk %s: %s", name, err)
+			return ""
+		}
+	}
+
+	return name
+}
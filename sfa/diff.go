@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const (
+	diffAdded    = "A"
+	diffDeleted  = "D"
+	diffModified = "M"
+)
+
+// DiffEntry is a path that differs between two states of a directory tree.
+type DiffEntry struct {
+	Change string
+	Path   string
+}
+
+// DiffEntries sorts DiffEntry values by path.
+type DiffEntries []DiffEntry
+
+func (entries DiffEntries) Len() int {
+	return len(entries)
+}
+
+func (entries DiffEntries) Less(i, j int) bool {
+	return entries[i].Path < entries[j].Path
+}
+
+func (entries DiffEntries) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
+
+// diffSource prints the paths that would be added, modified or deleted if
+// inputDir was archived to outputDir. Like archive, files are modified if
+// their size or modification time changed. Paths that changed between file and
+// directory are modified as well.
+func diffSource(inputDir string, outputDir string) {
+	doc, err := readIndex(outputDir)
+
+	utils.PanicIfErr(err)
+
+	entries := DiffEntries{}
+	removedPaths := getRemovedPathsMap(doc)
+	excludes := getExcludes(*diffExcludes)
+
+	walkFn := walkSourceFn(inputDir, outputDir, excludes, *diffSymlinks, func(fullPath string, shortPath string, fileInfo os.FileInfo) error {
+		delete(removedPaths, shortPath)
+		file, exists := doc.Files[shortPath]
+
+		if !exists {
+			entries = append(entries, DiffEntry{Change: diffAdded, Path: shortPath})
+			return nil
+		}
+
+		if sourceFileHasChanged(file, fileInfo) {
+			entries = append(entries, DiffEntry{Change: diffModified, Path: shortPath})
+		}
+
+		return nil
+	})
+
+	err = filepath.Walk(inputDir, walkFn)
+
+	utils.PanicIfErr(err)
+
+	for shortPath := range removedPaths {
+		entries = append(entries, DiffEntry{Change: diffDeleted, Path: shortPath})
+	}
+
+	printDiffEntries(entries)
+}
+
+// sourceFileHasChanged returns true if file in the index differs from the path
+// in the source directory with fileInfo.
+func sourceFileHasChanged(file models.File, fileInfo os.FileInfo) bool {
+	if file.IsDirectory != fileInfo.IsDir() {
+		return true
+	}
+
+	if fileInfo.IsDir() {
+		return false
+	}
+
+	archive := ArchiveInfo{
+		File:     file,
+		FileInfo: fileInfo,
+		FileSize: uint64(fileInfo.Size()),
+	}
+
+	return fileHasChanged(&archive)
+}
+
+// diffHistory prints the paths in the archive in inputDir that differ between
+// the states at from and to.
+func diffHistory(inputDir string, fromStr string, toStr string) {
+	doc, err := readIndex(inputDir)
+
+	utils.PanicIfErr(err)
+
+	from, err := utils.ParsePointInTime(fromStr)
+
+	utils.PanicIfErr(err)
+
+	to := time.Now()
+
+	if len(toStr) != 0 {
+		to, err = utils.ParsePointInTime(toStr)
+
+		utils.PanicIfErr(err)
+	}
+
+	utils.Info.Printf("comparing %s with %s", from.Format(displayTimeFormat), to.Format(displayTimeFormat))
+
+	printDiffEntries(getDiffEntries(doc.GetFilesAt(from), doc.GetFilesAt(to)))
+}
+
+// getDiffEntries compares the files in from with the files in to. Files are
+// modified if their content or modification time differs.
+func getDiffEntries(from map[string]models.File, to map[string]models.File) DiffEntries {
+	entries := DiffEntries{}
+
+	for shortPath, fromFile := range from {
+		toFile, exists := to[shortPath]
+
+		if !exists {
+			entries = append(entries, DiffEntry{Change: diffDeleted, Path: shortPath})
+			continue
+		}
+
+		if fromFile.IsDirectory && toFile.IsDirectory {
+			continue
+		}
+
+		if fromFile.IsDirectory != toFile.IsDirectory ||
+			fromFile.Size != toFile.Size ||
+			!fromFile.ModificationTime.Equal(toFile.ModificationTime.Time) ||
+			!chunksAreEqual(fromFile.Chunks, toFile.Chunks) {
+
+			entries = append(entries, DiffEntry{Change: diffModified, Path: shortPath})
+		}
+	}
+
+	for shortPath := range to {
+		if _, exists := from[shortPath]; !exists {
+			entries = append(entries, DiffEntry{Change: diffAdded, Path: shortPath})
+		}
+	}
+
+	return entries
+}
+
+func printDiffEntries(entries DiffEntries) {
+	counts := map[string]int{}
+
+	sort.Sort(entries)
+
+	for _, entry := range entries {
+		if len(entry.Path) == 0 {
+			entry.Path = "."
+		}
+
+		counts[entry.Change]++
+		fmt.Printf("%s %s\n", entry.Change, entry.Path)
+	}
+
+	utils.Info.Printf("%d added, %d modified, %d deleted",
+		counts[diffAdded], counts[diffModified], counts[diffDeleted])
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/srhnsn/securefilearchiver/models"
+)
+
+func TestSourceFileHasChanged(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+	err := os.WriteFile(filename, []byte("content"), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileInfo, err := os.Stat(filename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirInfo, err := os.Stat(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := models.File{
+		Size:             uint64(fileInfo.Size()),
+		ModificationTime: models.JSONTime{Time: fileInfo.ModTime()},
+	}
+
+	directory := models.File{
+		IsDirectory:      true,
+		ModificationTime: models.JSONTime{Time: dirInfo.ModTime()},
+	}
+
+	changedFile := file
+	changedFile.Size++
+
+	for _, test := range []struct {
+		name     string
+		file     models.File
+		fileInfo os.FileInfo
+		changed  bool
+	}{
+		{"UnchangedFile", file, fileInfo, false},
+		{"ChangedFile", changedFile, fileInfo, true},
+		{"UnchangedDirectory", directory, dirInfo, false},
+		{"FileToDirectory", file, dirInfo, true},
+		{"DirectoryToFile", directory, fileInfo, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if changed := sourceFileHasChanged(test.file, test.fileInfo); changed != test.changed {
+				t.Fatalf("sourceFileHasChanged returned %t, want %t", changed, test.changed)
+			}
+		})
+	}
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/srhnsn/securefilearchiver/backend"
 	"github.com/srhnsn/securefilearchiver/models"
 	"github.com/srhnsn/securefilearchiver/utils"
 )
@@ -17,13 +17,17 @@ const (
 	currentIndexVersion     = 1
 	databaseFilename        = "index.json"
 	unusedChunksDeleteBatch = "delete unused chunks.bat"
+
+	// Packs where less than this fraction of the data is still used are
+	// repacked during garbage collection.
+	packRepackThreshold = 0.5
 )
 
 type chunkIndexMap map[string]bool
 type removedPathsMap map[string]bool
 
 func createUnusedChunksDeleteBatch(files []string, directory string) {
-	if len(files) == 0 {
+	if len(files) == 0 || *dryRun {
 		return
 	}
 
@@ -32,11 +36,11 @@ func createUnusedChunksDeleteBatch(files []string, directory string) {
 	out := []string{"@echo off", ""}
 
 	for _, file := range files {
-		out = append(out, getDeleteCmd(file))
+		out = append(out, batchScript{}.Delete(filepath.FromSlash(file)))
 	}
 
 	out = append(out, "")
-	out = append(out, getDeleteCmd(unusedChunksDeleteBatch))
+	out = append(out, batchScript{}.Delete(unusedChunksDeleteBatch))
 	out = append(out, "")
 	out = append(out, "pause")
 
@@ -44,8 +48,35 @@ func createUnusedChunksDeleteBatch(files []string, directory string) {
 	utils.MustWriteFile(batchPath, data)
 }
 
-func decryptIndexKey(doc *models.Document, password string) {
-	doc.KeyUnencrypted = string(utils.DecryptDataArmored([]byte(doc.KeyEncrypted), password))
+// deleteUnusedChunks deletes files from the archive in directory. It is used
+// instead of a batch file for archives that are not in a local directory.
+func deleteUnusedChunks(files []string, directory string) {
+	if *dryRun {
+		return
+	}
+
+	store := getBackend(directory)
+
+	for _, file := range files {
+		utils.Trace.Printf("deleting %s", file)
+		err := store.Delete(file)
+
+		if err != nil {
+			utils.Error.Printf("cannot delete %s: %s", file, err)
+		}
+	}
+}
+
+func decryptIndexKey(doc *models.Document, password string) error {
+	key, err := utils.DecryptDataArmored([]byte(doc.KeyEncrypted), password)
+
+	if err != nil {
+		return err
+	}
+
+	doc.KeyUnencrypted = string(key)
+
+	return nil
 }
 
 func encryptIndexKey(doc *models.Document, password string) {
@@ -53,67 +84,92 @@ func encryptIndexKey(doc *models.Document, password string) {
 	doc.KeyEncrypted = string(key)
 }
 
-func garbageCollect(inputDir string) {
-	doc, err := readIndex(getExistingIndexFilename(inputDir))
+// garbageCollect repacks partly unused packs and removes the chunk and pack
+// files that are not used by doc. If doc is nil, the index is read from
+// inputDir.
+func garbageCollect(inputDir string, doc *models.Document) {
+	if doc == nil {
+		var err error
+		doc, err = readIndex(inputDir)
 
-	utils.PanicIfErr(err)
+		utils.PanicIfErr(err)
+	}
+
+	utils.Info.Println("checking for partly unused packs")
+
+	if repackPacks(inputDir, doc) {
+		saveIndex(inputDir, doc)
+	}
 
 	utils.Info.Println("checking for unused chunks")
 	chunkIndex := getChunkIndexMap(doc)
-	unusedChunks := getUnusedChunks(chunkIndex, inputDir)
-	createUnusedChunksDeleteBatch(unusedChunks, inputDir)
+	unusedChunks, unusedData := getUnusedChunks(chunkIndex, inputDir)
 
-	if len(unusedChunks) > 0 {
-		utils.Info.Printf("found %d unused chunks", len(unusedChunks))
+	if backend.IsURL(inputDir) {
+		deleteUnusedChunks(unusedChunks, inputDir)
 	} else {
+		createUnusedChunksDeleteBatch(unusedChunks, inputDir)
+	}
+
+	if len(unusedChunks) == 0 {
 		utils.Info.Printf("no unused chunks")
+	} else if *dryRun {
+		utils.Info.Printf("dry run, found %d unused chunk and pack files (%s) that would be deleted", len(unusedChunks), utils.FormatFileSize(unusedData))
+
+		for _, unusedChunk := range unusedChunks {
+			utils.Trace.Printf("would delete %s", unusedChunk)
+		}
+	} else if backend.IsURL(inputDir) {
+		utils.Info.Printf("deleted %d unused chunks (%s)", len(unusedChunks), utils.FormatFileSize(unusedData))
+	} else {
+		utils.Info.Printf("found %d unused chunks (%s)", len(unusedChunks), utils.FormatFileSize(unusedData))
 	}
 }
 
+// getChunkIndexMap returns the names of all chunks and the IDs of all packs
+// that are used in doc.
 func getChunkIndexMap(doc *models.Document) chunkIndexMap {
 	chunkIndex := chunkIndexMap{}
 
-	for _, file := range doc.Files {
-		for _, chunk := range file.Chunks {
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		if len(chunk.Pack) != 0 {
+			chunkIndex[chunk.Pack] = true
+		} else {
 			chunkIndex[chunk.Name] = true
 		}
-	}
-
-	for _, fileVersions := range doc.DeletedFiles {
-		for _, file := range fileVersions {
-			for _, chunk := range file.Chunks {
-				chunkIndex[chunk.Name] = true
-			}
-		}
-	}
+	})
 
 	return chunkIndex
 }
 
+// getExistingIndexFilename returns the name of the index file in the archive
+// in directory. If there is none, the name of a new index file is returned.
 func getExistingIndexFilename(directory string) string {
-	base := filepath.Join(directory, databaseFilename)
+	base := databaseFilename
 
-	if utils.FileExists(base) {
+	if archiveFileExists(directory, base) {
 		return base
 	}
 
-	if utils.FileExists(base + ZipSuffix) {
+	if archiveFileExists(directory, base+ZipSuffix) {
 		return base + ZipSuffix
 	}
 
-	if utils.FileExists(base + EncSuffix) {
+	if archiveFileExists(directory, base+EncSuffix) {
 		return base + EncSuffix
 	}
 
-	if utils.FileExists(base + ZipSuffix + EncSuffix) {
+	if archiveFileExists(directory, base+ZipSuffix+EncSuffix) {
 		return base + ZipSuffix + EncSuffix
 	}
 
-	return getIndexFilename(directory)
+	return getIndexFilename()
 }
 
-func getIndexFilename(directory string) string {
-	filename := filepath.Join(directory, databaseFilename)
+// getIndexFilename returns the name of the index file with the suffixes that
+// are selected by --noindexzip and --noindexenc.
+func getIndexFilename() string {
+	filename := databaseFilename
 
 	if !*noIndexZip {
 		filename += ZipSuffix
@@ -134,50 +190,47 @@ func getNewDocument() *models.Document {
 		KeyUnencrypted: keyUnencrypted,
 		Files:          map[string]models.File{},
 		DeletedFiles:   map[string][]models.File{},
+		Chunking:       getDefaultChunking(),
+		ChunkNames:     models.ChunkNamesHMAC,
 	}
 }
 
-func getUnusedChunks(chunkIndex chunkIndexMap, directory string) []string {
+// getUnusedChunks returns the paths of the chunk and pack files in directory
+// that are not in chunkIndex and their total size.
+func getUnusedChunks(chunkIndex chunkIndexMap, directory string) ([]string, uint64) {
 	unusedChunks := []string{}
+	var unusedData uint64
 
-	encryptedIndexName := databaseFilename + EncSuffix
-
-	walkFn := func(fullPath string, fileInfo os.FileInfo, err error) error {
-		if fileInfo.IsDir() {
-			return nil
-		}
-
-		filename := fileInfo.Name()
-
-		if !strings.HasSuffix(filename, EncSuffix) {
-			return nil
-		}
-
-		if filename == encryptedIndexName {
-			return nil
-		}
-
-		chunkName := filename[:len(filename)-len(EncSuffix)]
-
+	for chunkName, chunkFile := range scanChunkFiles(directory) {
 		_, exists := chunkIndex[chunkName]
 
-		if exists {
-			return nil
+		if !exists {
+			unusedChunks = append(unusedChunks, chunkFile.Path)
+			unusedData += chunkFile.Size
 		}
+	}
 
-		relativePath, err := filepath.Rel(directory, fullPath)
+	sort.Strings(unusedChunks)
 
-		utils.PanicIfErr(err)
+	return unusedChunks, unusedData
+}
 
-		unusedChunks = append(unusedChunks, relativePath)
+// getPackUsage returns the number of bytes in each pack that are used by
+// chunks in doc.
+func getPackUsage(doc *models.Document) map[string]uint64 {
+	usage := map[string]uint64{}
+	seen := map[string]bool{}
 
-		return nil
-	}
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		if len(chunk.Pack) == 0 || seen[chunk.Name] {
+			return
+		}
 
-	err := filepath.Walk(directory, walkFn)
-	utils.PanicIfErr(err)
+		seen[chunk.Name] = true
+		usage[chunk.Pack] += chunk.Length
+	})
 
-	return unusedChunks
+	return usage
 }
 
 func getRemovedPathsMap(doc *models.Document) removedPathsMap {
@@ -190,8 +243,11 @@ func getRemovedPathsMap(doc *models.Document) removedPathsMap {
 	return paths
 }
 
-func pruneFiles(inputDir string, pruneRangeStr string) {
-	doc, err := readIndex(getExistingIndexFilename(inputDir))
+// pruneFiles removes the deleted files that are older than pruneRangeStr from
+// the index in inputDir and returns the pruned index. With --dry-run, the
+// index is not saved, so the returned index is the only pruned copy.
+func pruneFiles(inputDir string, pruneRangeStr string) *models.Document {
+	doc, err := readIndex(inputDir)
 
 	utils.PanicIfErr(err)
 
@@ -205,6 +261,7 @@ func pruneFiles(inputDir string, pruneRangeStr string) {
 		pruneThreshold, pruneRange)
 
 	var prunedFiles uint64
+	var prunedData uint64
 
 	for shortPath, versions := range doc.DeletedFiles {
 		newVersions := []models.File{}
@@ -221,6 +278,8 @@ func pruneFiles(inputDir string, pruneRangeStr string) {
 			}
 
 			prunedFiles++
+			prunedData += file.Size
+			utils.Trace.Printf("pruning version of %s deleted at %s", shortPath, file.DeletedAt.Time)
 		}
 
 		if len(newVersions) > 0 {
@@ -230,27 +289,45 @@ func pruneFiles(inputDir string, pruneRangeStr string) {
 		}
 	}
 
-	utils.Info.Printf("pruned %d files\n", prunedFiles)
+	if *dryRun {
+		utils.Info.Printf("dry run, would prune %d files (%s)\n", prunedFiles, utils.FormatFileSize(prunedData))
+	} else {
+		utils.Info.Printf("pruned %d files (%s), run index --gc to remove unused chunks\n", prunedFiles, utils.FormatFileSize(prunedData))
+	}
 
-	saveIndex(getIndexFilename(inputDir), doc)
+	saveIndex(inputDir, doc)
+
+	return doc
 }
 
-func readIndex(filename string) (*models.Document, error) {
+// readIndex reads the index of the archive in directory. If there is no
+// index, a new one is returned.
+func readIndex(directory string) (*models.Document, error) {
 	utils.Info.Println("reading index")
 
-	if !utils.FileExists(filename) {
-		utils.Info.Printf("no index found at %s, creating new archive\n", filename)
+	filename := getExistingIndexFilename(directory)
+
+	if !archiveFileExists(directory, filename) {
+		utils.Info.Printf("no index found in %s, creating new archive\n", backend.Redact(directory))
 
 		return getNewDocument(), nil
 	}
 
-	data, err := ioutil.ReadFile(filename)
+	return readIndexFile(directory, filename)
+}
+
+func readIndexFile(directory string, filename string) (*models.Document, error) {
+	data, err := getBackend(directory).Get(filename)
 
 	if err != nil {
 		return nil, err
 	}
 
-	data = unpackIndex(data, filename)
+	data, err = unpackIndex(data, filename)
+
+	if err != nil {
+		return nil, err
+	}
 
 	var document models.Document
 
@@ -260,12 +337,94 @@ func readIndex(filename string) (*models.Document, error) {
 		return nil, err
 	}
 
-	decryptIndexKey(&document, getPassword())
+	err = decryptIndexKey(&document, getPassword())
+
+	if err != nil {
+		return nil, err
+	}
 
 	return &document, nil
 }
 
-func saveIndex(filename string, doc *models.Document) {
+// repackPacks copies the used chunks of packs that are mostly unused into new
+// packs and updates doc accordingly. The old packs are then unused and removed
+// like unused chunks. It returns true if doc was changed.
+func repackPacks(inputDir string, doc *models.Document) bool {
+	repack := map[string]bool{}
+
+	for packID, usedBytes := range getPackUsage(doc) {
+		fileInfo, err := getBackend(inputDir).Stat(getPackFilename(packID))
+
+		if err != nil {
+			utils.Error.Printf("cannot check pack %s: %s", packID, err)
+			continue
+		}
+
+		if float64(usedBytes) >= packRepackThreshold*float64(fileInfo.Size) {
+			continue
+		}
+
+		utils.Trace.Printf("repacking pack %s (%s of %s used)", packID,
+			utils.FormatFileSize(usedBytes), utils.FormatFileSize(fileInfo.Size))
+		repack[packID] = true
+	}
+
+	if len(repack) == 0 {
+		return false
+	}
+
+	store := &ChunkStore{
+		OutputDir:   inputDir,
+		Packing:     doc.Packing,
+		locations:   map[string]models.Chunk{},
+		failedPacks: map[string]bool{},
+	}
+
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		if !repack[chunk.Pack] {
+			return
+		}
+
+		location, exists := store.locations[chunk.Name]
+
+		if !exists {
+			ciphertext, err := readChunk(inputDir, *chunk)
+
+			if err != nil {
+				utils.Error.Printf("cannot repack chunk %s: %s", chunk.Name, err)
+				return
+			}
+
+			location = *chunk
+			err = store.savePacked(&location, ciphertext)
+
+			utils.PanicIfErr(err)
+		}
+
+		setChunkLocation(chunk, location)
+	})
+
+	err := store.flush()
+
+	utils.PanicIfErr(err)
+
+	if *dryRun {
+		utils.Info.Printf("dry run, would repack %d chunks (%s) from %d packs", len(store.locations), utils.FormatFileSize(store.SavedData), len(repack))
+	} else {
+		utils.Info.Printf("repacked %d chunks from %d packs", len(store.locations), len(repack))
+	}
+
+	return true
+}
+
+// saveIndex writes doc to the archive in directory. The index is written to a
+// temporary file first, which is only renamed after it was validated.
+func saveIndex(directory string, doc *models.Document) {
+	if *dryRun {
+		utils.Info.Println("dry run, not writing index")
+		return
+	}
+
 	utils.Info.Println("writing to index")
 
 	encryptIndexKey(doc, getPassword())
@@ -281,20 +440,28 @@ func saveIndex(filename string, doc *models.Document) {
 		data = utils.EncryptData(data, getPassword())
 	}
 
+	store := getBackend(directory)
+	filename := getIndexFilename()
 	tempFilename := filename + utils.TmpSuffix
-	utils.MustWriteFile(tempFilename, data)
+	err = putWithRetry(directory, tempFilename, data)
+
+	utils.PanicIfErr(err)
 
 	utils.Info.Println("validating index")
-	err = validateIndex(tempFilename, doc)
+	err = validateIndex(directory, tempFilename, doc)
 
 	utils.PanicIfErr(err)
 
-	err = os.Rename(tempFilename, filename)
+	err = store.Rename(tempFilename, filename)
 
 	utils.PanicIfErr(err)
+
+	saveManifest(directory, doc)
 }
 
-func unpackIndex(data []byte, filename string) []byte {
+func unpackIndex(data []byte, filename string) ([]byte, error) {
+	var err error
+
 	if strings.HasSuffix(filename, utils.TmpSuffix) {
 		// Strip TmpSuffix
 		filename = filename[:len(filename)-len(utils.TmpSuffix)]
@@ -303,18 +470,22 @@ func unpackIndex(data []byte, filename string) []byte {
 	if strings.HasSuffix(filename, EncSuffix) {
 		// Strip EncSuffix and decrypt
 		filename = filename[:len(filename)-len(EncSuffix)]
-		data = utils.DecryptData(data, getPassword())
+		data, err = utils.DecryptData(data, getPassword())
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if strings.HasSuffix(filename, ZipSuffix) {
-		data = utils.UncompressData(data)
+		data, err = utils.UncompressData(data)
 	}
 
-	return data
+	return data, err
 }
 
-func validateIndex(filename string, oldDoc *models.Document) error {
-	doc, err := readIndex(filename)
+func validateIndex(directory string, filename string, oldDoc *models.Document) error {
+	doc, err := readIndexFile(directory, filename)
 
 	if err != nil {
 		return err
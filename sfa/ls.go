@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// ListEntry is a version of a file or directory that is listed by ls.
+type ListEntry struct {
+	Path    string
+	File    models.File
+	Added   time.Time
+	Deleted bool
+}
+
+// ListEntries sorts ListEntry values by their path components, so that the
+// content of a directory directly follows the directory.
+type ListEntries []ListEntry
+
+func (entries ListEntries) Len() int {
+	return len(entries)
+}
+
+func (entries ListEntries) Less(i, j int) bool {
+	return strings.Replace(entries[i].Path, "/", "\x00", -1) < strings.Replace(entries[j].Path, "/", "\x00", -1)
+}
+
+func (entries ListEntries) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
+
+// listFiles prints the paths in the archive in inputDir that match pattern.
+// Matching directories are listed with their content.
+func listFiles(inputDir string, pattern string) {
+	doc, err := readIndex(inputDir)
+
+	utils.PanicIfErr(err)
+
+	asOf := time.Now()
+
+	if len(*lsAsOf) != 0 {
+		asOf, err = utils.ParsePointInTime(*lsAsOf)
+
+		utils.PanicIfErr(err)
+
+		utils.Info.Printf("listing files as of %s", asOf)
+	}
+
+	entries := getListEntries(doc, asOf, *lsDeleted)
+	entries = filterListEntries(entries, getIndexPath(pattern), *lsRecursive || *lsTree)
+
+	printListEntries(entries)
+}
+
+// getListEntries returns the versions of all paths in doc that existed at
+// asOf, sorted by path. With deleted, versions that were deleted before asOf
+// are included as well.
+func getListEntries(doc *models.Document, asOf time.Time, deleted bool) ListEntries {
+	paths := map[string]bool{}
+
+	for shortPath := range doc.Files {
+		paths[shortPath] = true
+	}
+
+	for shortPath := range doc.DeletedFiles {
+		paths[shortPath] = true
+	}
+
+	entries := ListEntries{}
+
+	for shortPath := range paths {
+		versions := doc.GetFileVersions(shortPath)
+
+		for i, file := range versions {
+			added := models.GetVersionStart(versions, i)
+
+			if asOf.Before(added) {
+				continue
+			}
+
+			isDeleted := file.DeletedAt != nil && !asOf.Before(file.DeletedAt.Time)
+
+			if isDeleted && !deleted {
+				continue
+			}
+
+			entries = append(entries, ListEntry{
+				Path:    shortPath,
+				File:    file,
+				Added:   added,
+				Deleted: isDeleted,
+			})
+		}
+	}
+
+	// The versions of a path were added in order, which the stable sort keeps.
+	sort.Stable(entries)
+
+	return entries
+}
+
+// filterListEntries returns the entries that match pattern. Like ls, matching
+// directories are replaced by their content. With recursive, the content of
+// subdirectories is included as well.
+func filterListEntries(entries ListEntries, pattern string, recursive bool) ListEntries {
+	matches := map[string]bool{}
+	directories := map[string]bool{}
+
+	for _, entry := range entries {
+		if glob.Glob(pattern, entry.Path) {
+			matches[entry.Path] = true
+		}
+
+		if entry.File.IsDirectory {
+			directories[entry.Path] = true
+		}
+	}
+
+	// The root directory is not always in the index.
+	if len(pattern) == 0 {
+		matches[""] = true
+		directories[""] = true
+	}
+
+	result := ListEntries{}
+
+	for _, entry := range entries {
+		if len(entry.Path) == 0 {
+			continue
+		}
+
+		parent := getParentPath(entry.Path)
+		include := matches[parent] && directories[parent]
+
+		if matches[entry.Path] && !entry.File.IsDirectory {
+			include = true
+		}
+
+		for ancestor := entry.Path; recursive && !include; ancestor = getParentPath(ancestor) {
+			include = matches[ancestor]
+
+			if len(ancestor) == 0 {
+				break
+			}
+		}
+
+		if include {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+// getParentPath returns the parent directory of the index path shortPath.
+func getParentPath(shortPath string) string {
+	parent := path.Dir(shortPath)
+
+	if parent == "." {
+		return ""
+	}
+
+	return parent
+}
+
+func printListEntries(entries ListEntries) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	minDepth := -1
+
+	for _, entry := range entries {
+		depth := strings.Count(entry.Path, "/")
+
+		if minDepth == -1 || depth < minDepth {
+			minDepth = depth
+		}
+	}
+
+	if *lsLong {
+		header := "Size\tChunks\tModified\tAdded\t"
+
+		if *lsDeleted {
+			header += "Deleted\t"
+		}
+
+		fmt.Fprintln(writer, header+"Path")
+	}
+
+	for _, entry := range entries {
+		name := entry.Path
+
+		if *lsTree {
+			name = strings.Repeat("  ", strings.Count(entry.Path, "/")-minDepth) + path.Base(entry.Path)
+		}
+
+		if entry.File.IsDirectory {
+			name += "/"
+		}
+
+		if !*lsLong {
+			if entry.Deleted {
+				name += fmt.Sprintf(" (deleted %s)", entry.File.DeletedAt.Local().Format(displayTimeFormat))
+			}
+
+			fmt.Fprintln(writer, name)
+			continue
+		}
+
+		size := utils.FormatFileSize(entry.File.Size)
+
+		if entry.File.IsDirectory {
+			size = "-"
+		}
+
+		line := fmt.Sprintf("%s\t%d\t%s\t%s\t",
+			size,
+			len(entry.File.Chunks),
+			entry.File.ModificationTime.Local().Format(displayTimeFormat),
+			entry.Added.Local().Format(displayTimeFormat),
+		)
+
+		if *lsDeleted {
+			deleted := "-"
+
+			if entry.Deleted {
+				deleted = entry.File.DeletedAt.Local().Format(displayTimeFormat)
+			}
+
+			line += deleted + "\t"
+		}
+
+		fmt.Fprintln(writer, line+name)
+	}
+
+	writer.Flush()
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"os"
+	"runtime"
+	"strconv"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/srhnsn/securefilearchiver/models"
 	"github.com/srhnsn/securefilearchiver/utils"
 )
 
@@ -13,6 +16,8 @@ const (
 	EncSuffix = ".bin"
 	// ZipSuffix is the suffix for all compressed files.
 	ZipSuffix = ".gz"
+	// ZstdSuffix is the suffix for files compressed with Zstandard.
+	ZstdSuffix = ".zst"
 )
 
 var (
@@ -23,28 +28,95 @@ var (
 	quiet        = app.Flag("quiet", "Only print errors to console.").Bool()
 	verbose      = app.Flag("verbose", "Verbose output.").Bool()
 	logDirectory = app.Flag("log", "Log output to a file in this directory.").String()
-
-	archive          = app.Command("archive", "Archive files.")
-	archiveInputDir  = archive.Arg("source", "Source directory.").Required().String()
-	archiveOutputDir = archive.Arg("destination", "Destination directory").Required().String()
-	archiveExcludes  = archive.Flag("exclude-file", "Never archive paths that match the globs in this file.").String()
-	archiveSymlinks  = archive.Flag("follow-symlinks", "Follow and archive symbolic links. They are ignored otherwise.").Bool()
-
-	restore          = app.Command("restore", "Restore files.")
-	restoreInputDir  = restore.Arg("source", "Source directory.").Required().String()
-	restoreOutputDir = restore.Arg("destination", "Destination directory.").Required().String()
-	restorePattern   = restore.Flag("pattern", "A glob pattern to selectively restore files.").String()
+	dryRun       = app.Flag("dry-run", "Do not write chunks, packs, the index or delete batch files. archive, index --prune and index --gc only report what they would do.").Bool()
+
+	archive             = app.Command("archive", "Archive files.")
+	archiveInputDir     = archive.Arg("source", "Source directory.").Required().String()
+	archiveOutputDir    = archive.Arg("destination", "Destination directory").Required().String()
+	archiveExcludes     = archive.Flag("exclude-file", "Never archive paths that match the globs in this file.").String()
+	archiveSymlinks     = archive.Flag("follow-symlinks", "Follow and archive symbolic links. They are ignored otherwise.").Bool()
+	archiveChunking     = archive.Flag("chunking", "Chunking mode: fixed or cdc (content-defined). Defaults to the mode stored in the index.").Enum(models.ChunkingFixed, models.ChunkingContentDefined)
+	archiveChunkMin     = archive.Flag("chunk-min", "Minimum chunk size for content-defined chunking.").Bytes()
+	archiveChunkAvg     = archive.Flag("chunk-avg", "Average chunk size (exact chunk size for fixed chunking).").Bytes()
+	archiveChunkMax     = archive.Flag("chunk-max", "Maximum chunk size for content-defined chunking.").Bytes()
+	archiveChunkPolicy  = archive.Flag("chunk-policy", "Chunk size policy: constant or size-aware (larger chunks for large files). Defaults to the policy stored in the index.").Enum(models.ChunkPolicyConstant, models.ChunkPolicySizeAware)
+	archivePackSize     = archive.Flag("pack-size", "Bundle small chunks into pack files of this size (e.g. 32MiB, 0 disables packing). Defaults to the setting stored in the index.").String()
+	archivePackChunkMax = archive.Flag("pack-chunk-max", "Only chunks up to this size are bundled into pack files (default 1MiB).").Bytes()
+	archiveCompression  = archive.Flag("compress", "Compress chunks before encryption: none, gzip or zstd. Chunks that do not compress are stored uncompressed. Defaults to the setting stored in the index.").Enum(compressionNone, models.CompressionGzip, models.CompressionZstd)
+	archiveEncryption   = archive.Flag("chunk-encryption", "Chunk encryption: openpgp (can be decrypted with gpg2) or hkdf (AES-256-GCM with derived keys, much faster, needs sfa to restore). Defaults to the setting stored in the index.").Enum(models.EncryptionOpenPGP, models.EncryptionHKDF)
+	archiveChecksum     = archive.Flag("checksum", "Compare the content hash of files whose modification time changed, so that files that were only touched are not archived again.").Bool()
+	archiveTrustMtime   = archive.Flag("trust-mtime", "Skip files whose size and modification time did not change. Use --trust-mtime=false to compare the content hash of all files.").Default("true").Enum("true", "false")
+	archiveJobs         = archive.Flag("jobs", "Number of files and chunks that are processed concurrently.").Default(strconv.Itoa(runtime.NumCPU())).Int()
+
+	restore             = app.Command("restore", "Restore files.")
+	restoreInputDir     = restore.Arg("source", "Source directory.").Required().String()
+	restoreOutputDir    = restore.Arg("destination", "Destination directory.").Required().String()
+	restorePattern      = restore.Flag("pattern", "A glob pattern to selectively restore files.").String()
+	restoreScriptFormat = restore.Flag("script-format", "Format of the restore script: bat (Windows), ps1 (PowerShell) or sh (Linux and macOS).").Default(scriptFormatBat).Enum(scriptFormatBat, scriptFormatPs1, scriptFormatSh)
+	restoreAsOf         = restore.Flag("as-of", "Restore the files as they existed at this time (e.g. \"2026-09-01 12:00\" or 2w for two weeks ago), including files that were deleted since.").String()
+	restoreNative       = restore.Flag("native", "Decrypt and restore the files directly instead of generating a restore script.").Bool()
+	restorePath         = restore.Flag("path", "Restore only a single version of this file (see the versions command).").String()
+	restoreVersion      = restore.Flag("version", "Restore this version of --path instead of the newest one: a version number or the time at which the version was added (see the versions command). Version numbers change when old versions are pruned.").String()
+	restoreOutputName   = restore.Flag("output-name", "Restore --path under this file name in the destination directory.").String()
+
+	decryptChunkCmd     = app.Command("decrypt-chunk", "Decrypt a single chunk that was encrypted with a derived key (used by restore scripts).")
+	decryptChunkInput   = decryptChunkCmd.Arg("source", "Encrypted chunk file.").Required().String()
+	decryptChunkOutput  = decryptChunkCmd.Arg("destination", "Decrypted output file.").Required().String()
+	decryptChunkKeyFile = decryptChunkCmd.Flag("key-file", "File that contains the document key.").Required().String()
+
+	lsCmd       = app.Command("ls", "List the files in an archive.")
+	lsInputDir  = lsCmd.Arg("source", "Source directory.").Required().String()
+	lsPattern   = lsCmd.Arg("path-glob", "Only list paths that match this glob. Matching directories are listed with their content.").String()
+	lsLong      = lsCmd.Flag("long", "Show size, chunk count, modification time and the time each version was added.").Short('l').Bool()
+	lsRecursive = lsCmd.Flag("recursive", "List the content of subdirectories as well.").Short('R').Bool()
+	lsTree      = lsCmd.Flag("tree", "Show the paths as an indented tree. Implies --recursive.").Bool()
+	lsDeleted   = lsCmd.Flag("deleted", "Also list deleted files and old versions of files.").Bool()
+	lsAsOf      = lsCmd.Flag("as-of", "List the files as they existed at this time (e.g. \"2026-09-01 12:00\" or 2w for two weeks ago).").String()
+
+	diffCmd      = app.Command("diff", "Show the paths that would change when archiving a source directory, or that changed in an archive between two points in time.")
+	diffFirst    = diffCmd.Arg("source", "Source directory, or the archive with --from.").Required().String()
+	diffArchive  = diffCmd.Arg("archive", "Archive directory to compare the source directory with.").String()
+	diffFrom     = diffCmd.Flag("from", "Compare the archive as it was at this time (e.g. \"2026-09-01 12:00\" or 2w for two weeks ago).").String()
+	diffTo       = diffCmd.Flag("to", "Compare with the archive as it was at this time instead of its current state.").String()
+	diffExcludes = diffCmd.Flag("exclude-file", "Ignore paths that match the globs in this file, like archive.").String()
+	diffSymlinks = diffCmd.Flag("follow-symlinks", "Follow symbolic links, like archive.").Bool()
+
+	checkCmd      = app.Command("check", "Verify that all chunks of an archive exist and can be decrypted. Exits with 3 if chunks are missing, 4 if chunks are corrupt and 5 if both.")
+	checkInputDir = checkCmd.Arg("source", "Source directory.").Required().String()
+	checkJobs     = checkCmd.Flag("jobs", "Number of chunks that are checked concurrently.").Default(strconv.Itoa(runtime.NumCPU())).Int()
+	checkCipher   = checkCmd.Flag("ciphertext-only", "Only compare the encrypted chunks with the hash sums in the unencrypted manifest. Needs no password.").Bool()
+	checkManifest = checkCmd.Flag("manifest", "Read the manifest for --ciphertext-only from this file instead of the archive, e.g. a copy that is kept on another host.").String()
+	checkSubset   = checkCmd.Flag("read-data-subset", "Only check a subset of the chunks: a percentage (e.g. 5%), the chunks that were not verified for the longest time first, or a slice n/m (e.g. 1/7) of the chunks.").String()
+
+	statsCmd      = app.Command("stats", "Show statistics about an archive.")
+	statsInputDir = statsCmd.Arg("source", "Source directory.").Required().String()
+	statsJSON     = statsCmd.Flag("json", "Print the statistics as JSON.").Bool()
+
+	versionsCmd      = app.Command("versions", "List all stored versions of a file or directory.")
+	versionsInputDir = versionsCmd.Arg("source", "Source directory.").Required().String()
+	versionsPath     = versionsCmd.Arg("path", "Path of the file or directory in the archive.").Required().String()
+
+	analyzeCmd          = app.Command("analyze-chunking", "Simulate different chunk sizes and chunking modes on a source directory.")
+	analyzeInputDir     = analyzeCmd.Arg("source", "Source directory.").Required().String()
+	analyzeChunkSizes   = analyzeCmd.Flag("chunk-size", "Average chunk size to simulate. Can be repeated.").Default("1MiB", "4MiB", "16MiB").Strings()
+	analyzeExcludes     = analyzeCmd.Flag("exclude-file", "Ignore paths that match the globs in this file.").String()
+	analyzeSymlinks     = analyzeCmd.Flag("follow-symlinks", "Follow symbolic links. They are ignored otherwise.").Bool()
+	analyzePackSize     = analyzeCmd.Flag("pack-size", "Simulate bundling small chunks into pack files of this size (e.g. 32MiB).").String()
+	analyzePackChunkMax = analyzeCmd.Flag("pack-chunk-max", "Only chunks up to this size are bundled into pack files (default 1MiB).").Bytes()
 
 	indexCmd      = app.Command("index", "Index operations.")
 	indexInputDir = indexCmd.Arg("source", "Source directory.").Required().String()
 	indexPrune    = indexCmd.Flag("prune", "Prune deleted files older than a specific time range.").String()
 	indexGC       = indexCmd.Flag("gc", "Remove unused chunks.").Bool()
+	indexMigrate  = indexCmd.Flag("migrate-chunk-names", "Rename chunks to keyed names (HMAC-SHA256) and rewrite the index. Run --gc afterwards.").Bool()
+	indexHash     = indexCmd.Flag("hash-ciphertexts", "Verify the chunks that were archived without ciphertext hash and add their hash sums to the index and the manifest.").Bool()
 )
 
 func main() {
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	utils.InitLogger(*logDirectory, *quiet, *verbose)
+	defer closeBackends()
 
 	switch cmd {
 	case archive.FullCommand():
@@ -57,17 +129,83 @@ func main() {
 		input := normalizePath(*restoreInputDir)
 		output := normalizePath(*restoreOutputDir)
 
-		restoreFiles(input, output)
+		if *restoreNative {
+			restoreFilesNative(input, output)
+		} else {
+			restoreFiles(input, output)
+		}
+
+	case decryptChunkCmd.FullCommand():
+		decryptChunkFile(*decryptChunkInput, *decryptChunkOutput, *decryptChunkKeyFile)
+
+	case lsCmd.FullCommand():
+		input := normalizePath(*lsInputDir)
+
+		listFiles(input, *lsPattern)
+
+	case diffCmd.FullCommand():
+		input := normalizePath(*diffFirst)
+
+		if len(*diffTo) != 0 && len(*diffFrom) == 0 {
+			kingpin.Fatalf("--to needs --from")
+		}
+
+		if len(*diffFrom) != 0 {
+			diffHistory(input, *diffFrom, *diffTo)
+		} else if len(*diffArchive) != 0 {
+			diffSource(input, normalizePath(*diffArchive))
+		} else {
+			kingpin.Fatalf("diff needs an archive directory or --from")
+		}
+
+	case checkCmd.FullCommand():
+		input := normalizePath(*checkInputDir)
+
+		if len(*checkManifest) != 0 && !*checkCipher {
+			kingpin.Fatalf("--manifest needs --ciphertext-only")
+		}
+
+		checkArchive(input, *checkJobs, *checkSubset, *checkCipher, *checkManifest)
+
+	case statsCmd.FullCommand():
+		input := normalizePath(*statsInputDir)
+
+		showStats(input, *statsJSON)
+
+	case versionsCmd.FullCommand():
+		input := normalizePath(*versionsInputDir)
+
+		listVersions(input, *versionsPath)
+
+	case analyzeCmd.FullCommand():
+		input := normalizePath(*analyzeInputDir)
+
+		analyzeChunking(input)
 
 	case indexCmd.FullCommand():
 		input := normalizePath(*indexInputDir)
 
+		if *indexMigrate && *dryRun {
+			kingpin.Fatalf("--migrate-chunk-names does not support --dry-run")
+		}
+
+		if *indexMigrate {
+			migrateChunkNames(input)
+		}
+
+		if *indexHash {
+			hashCiphertexts(input)
+		}
+
+		// The pruned index is passed on because --dry-run does not save it.
+		var doc *models.Document
+
 		if len(*indexPrune) != 0 {
-			pruneFiles(input, *indexPrune)
+			doc = pruneFiles(input, *indexPrune)
 		}
 
 		if *indexGC {
-			garbageCollect(input)
+			garbageCollect(input, doc)
 		}
 	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/srhnsn/securefilearchiver/backend"
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// manifestFilename is the unencrypted list of the stored chunks and the hash
+// sums of their encrypted data. It is rewritten whenever the index is saved.
+// Chunks in pack files are listed by location only, so that their names stay
+// secret.
+const manifestFilename = "manifest.json"
+
+// getManifest returns the manifest of the chunks in doc, sorted by location.
+func getManifest(doc *models.Document) models.Manifest {
+	manifest := models.Manifest{
+		Version: models.ManifestVersion,
+		Chunks:  []models.ManifestChunk{},
+	}
+
+	for _, chunk := range getCheckChunks(doc) {
+		name := chunk.Name
+
+		if len(chunk.Pack) != 0 {
+			name = ""
+		}
+
+		manifest.Chunks = append(manifest.Chunks, models.ManifestChunk{
+			Name:           name,
+			Pack:           chunk.Pack,
+			Offset:         chunk.Offset,
+			Length:         chunk.Length,
+			CiphertextHash: chunk.CiphertextHash,
+		})
+	}
+
+	return manifest
+}
+
+// readManifest reads the manifest of the archive in inputDir and returns its
+// chunks, sorted by location. If manifestPath is not empty, the manifest is
+// read from this local file instead, e.g. a copy that is kept on another host.
+func readManifest(inputDir string, manifestPath string) (ChunksByLocation, error) {
+	var data []byte
+	var err error
+
+	if len(manifestPath) != 0 {
+		data, err = ioutil.ReadFile(manifestPath)
+	} else {
+		data, err = getBackend(inputDir).Get(manifestFilename)
+
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no manifest found in %s", backend.Redact(inputDir))
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest models.Manifest
+
+	err = json.Unmarshal(data, &manifest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Version == 0 || manifest.Version > models.ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+
+	chunks := ChunksByLocation{}
+
+	for _, chunk := range manifest.Chunks {
+		name := chunk.Name
+
+		// Version 1 manifests have names for chunks in pack files.
+		if len(chunk.Pack) != 0 {
+			name = ""
+		}
+
+		chunks = append(chunks, models.Chunk{
+			Name:           name,
+			Pack:           chunk.Pack,
+			Offset:         chunk.Offset,
+			Length:         chunk.Length,
+			CiphertextHash: chunk.CiphertextHash,
+		})
+	}
+
+	return chunks, nil
+}
+
+// saveManifest writes the manifest of doc to outputDir.
+func saveManifest(outputDir string, doc *models.Document) {
+	data, err := json.MarshalIndent(getManifest(doc), "", "\t")
+
+	utils.PanicIfErr(err)
+
+	err = putWithRetry(outputDir, manifestFilename, data)
+
+	utils.PanicIfErr(err)
+}
+
+// hashCiphertexts stores the hash sums of the encrypted data of all chunks of
+// the archive in inputDir that were archived before ciphertext hashes were
+// introduced. As the hash sums cannot be trusted otherwise, every chunk is
+// decrypted and compared with its name first.
+func hashCiphertexts(inputDir string) {
+	doc, err := readIndex(inputDir)
+
+	utils.PanicIfErr(err)
+
+	chunkNameMatches := getChunkNameChecker(doc)
+	hashes := map[string]string{}
+
+	var failed uint64
+
+	utils.Info.Println("hashing chunks without ciphertext hash")
+
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		if len(chunk.CiphertextHash) != 0 {
+			return
+		}
+
+		hash, exists := hashes[chunk.Name]
+
+		if !exists {
+			hash = hashCiphertext(inputDir, doc, *chunk, chunkNameMatches)
+
+			if len(hash) == 0 {
+				failed++
+			}
+
+			hashes[chunk.Name] = hash
+		}
+
+		chunk.CiphertextHash = hash
+	})
+
+	saveIndex(inputDir, doc)
+
+	utils.Info.Printf("hashed %d chunks", uint64(len(hashes))-failed)
+
+	if failed > 0 {
+		utils.Error.Printf("%d chunks could not be hashed, run check for details", failed)
+	}
+}
+
+// hashCiphertext returns the hash sum of the encrypted data of chunk. It
+// returns an empty string if the chunk cannot be read or does not match its
+// name.
+func hashCiphertext(inputDir string, doc *models.Document, chunk models.Chunk, chunkNameMatches chunkNameChecker) string {
+	ciphertext, err := readChunk(inputDir, chunk)
+
+	if err != nil {
+		utils.Error.Printf("cannot read chunk %s: %s", chunk.Name, err)
+		return ""
+	}
+
+	data, err := decryptChunk(ciphertext, chunk, doc.KeyUnencrypted)
+
+	if err != nil {
+		utils.Error.Println(err)
+		return ""
+	}
+
+	if !chunkNameMatches(data, chunk.Name) {
+		utils.Error.Printf("chunk %s is corrupt, its content does not match its name", chunk.Name)
+		return ""
+	}
+
+	return utils.GetHashSum(ciphertext)
+}
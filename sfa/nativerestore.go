@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// NativeRestoreInfo holds the results of a native restore.
+type NativeRestoreInfo struct {
+	Directories uint64
+	Files       uint64
+	Data        uint64
+	Failed      []string
+	Skipped     []string
+}
+
+// restoreFilesNative restores the files of the archive in inputDir to
+// outputDir without any external tools. Files that cannot be restored are
+// reported and skipped.
+func restoreFilesNative(inputDir string, outputDir string) {
+	doc := readRestoreIndex(inputDir)
+
+	if len(*restorePattern) != 0 {
+		utils.Info.Printf("using restore pattern %s", *restorePattern)
+	}
+
+	var info NativeRestoreInfo
+	directories := []string{}
+	directoryDests := map[string]string{}
+	paths := getRestorePaths(doc)
+
+	logUnverifiedFiles(doc, paths)
+
+	for _, shortPath := range paths {
+		file := doc.Files[shortPath]
+		dest, err := getNativeRestoreDest(outputDir, shortPath)
+
+		if err != nil {
+			utils.Error.Printf("skipping %q: %s", shortPath, err)
+			info.Skipped = append(info.Skipped, shortPath)
+			continue
+		}
+
+		if file.IsDirectory {
+			utils.Trace.Printf("creating directory %s", shortPath)
+			err = os.MkdirAll(dest, 0700)
+
+			if err == nil {
+				info.Directories++
+				directories = append(directories, shortPath)
+				directoryDests[shortPath] = dest
+			}
+		} else {
+			utils.Trace.Printf("restoring %s", shortPath)
+			err = restoreFileNative(inputDir, dest, file, doc.KeyUnencrypted)
+
+			if err == nil {
+				info.Files++
+				info.Data += file.Size
+			}
+		}
+
+		if err != nil {
+			utils.Error.Printf("cannot restore %s: %s", shortPath, err)
+			info.Failed = append(info.Failed, shortPath)
+		}
+	}
+
+	// Directory modification times change while their content is restored,
+	// so they are set last, deepest directories first.
+	for i := len(directories) - 1; i >= 0; i-- {
+		file := doc.Files[directories[i]]
+		dest := directoryDests[directories[i]]
+		err := os.Chtimes(dest, file.ModificationTime.Time, file.ModificationTime.Time)
+
+		if err != nil {
+			utils.Error.Printf("cannot set modification time of %s: %s", directories[i], err)
+		}
+	}
+
+	printNativeRestoreInfo(info)
+
+	if len(info.Failed) > 0 || len(info.Skipped) > 0 {
+		os.Exit(1)
+	}
+}
+
+// getNativeRestoreDest returns the path to which shortPath is restored in
+// outputDir. Absolute paths and paths that would end up outside of outputDir,
+// which can only be found in a damaged or manipulated index, are rejected.
+func getNativeRestoreDest(outputDir string, shortPath string) (string, error) {
+	localPath := filepath.FromSlash(shortPath)
+
+	if filepath.IsAbs(localPath) || len(filepath.VolumeName(localPath)) != 0 || strings.HasPrefix(shortPath, "/") {
+		return "", fmt.Errorf("path is absolute")
+	}
+
+	dest := filepath.Join(outputDir, localPath)
+	rel, err := filepath.Rel(outputDir, dest)
+
+	if err != nil {
+		return "", err
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path is outside of the output directory")
+	}
+
+	return dest, nil
+}
+
+// restoreFileNative decrypts the chunks of file and writes them to dest. The
+// file is first written to a temporary file, which is renamed once all chunks
+// were written. If the content does not match the checksum in the index, the
+// file is kept but an error is returned.
+func restoreFileNative(inputDir string, dest string, file models.File, key string) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	tmpDest := dest + utils.TmpSuffix
+	output, err := os.OpenFile(tmpDest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+
+	if err != nil {
+		return err
+	}
+
+	hash := utils.NewHash()
+	err = writeChunksNative(inputDir, io.MultiWriter(output, hash), file, key)
+	closeErr := output.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpDest, dest)
+	}
+
+	if err != nil {
+		os.Remove(tmpDest)
+		return err
+	}
+
+	err = os.Chtimes(dest, file.ModificationTime.Time, file.ModificationTime.Time)
+
+	if err != nil {
+		return err
+	}
+
+	if len(file.Hash) != 0 {
+		actualHash := hex.EncodeToString(hash.Sum(nil))
+
+		if actualHash != file.Hash {
+			utils.Error.Printf("CHECKSUM MISMATCH: %s", dest)
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", file.Hash, actualHash)
+		}
+	}
+
+	return nil
+}
+
+func printNativeRestoreInfo(info NativeRestoreInfo) {
+	utils.Info.Printf("restored %d files (%s) and %d directories",
+		info.Files, utils.FormatFileSize(info.Data), info.Directories)
+
+	if len(info.Skipped) > 0 {
+		utils.Error.Printf("%d paths were skipped because they are not inside the output directory:", len(info.Skipped))
+
+		for _, shortPath := range info.Skipped {
+			utils.Error.Printf("    %q", shortPath)
+		}
+	}
+
+	if len(info.Failed) > 0 {
+		utils.Error.Printf("%d paths could not be restored:", len(info.Failed))
+
+		for _, shortPath := range info.Failed {
+			utils.Error.Printf("    %s", shortPath)
+		}
+	}
+}
+
+func writeChunksNative(inputDir string, writer io.Writer, file models.File, key string) error {
+	for chunkNo, chunk := range file.Chunks {
+		ciphertext, err := readChunk(inputDir, chunk)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := decryptChunk(ciphertext, chunk, key)
+
+		if err != nil {
+			return err
+		}
+
+		if uint64(len(data)) != chunk.Size {
+			return fmt.Errorf("chunk #%d (%s) has %d bytes instead of %d", chunkNo+1, chunk.Name, len(data), chunk.Size)
+		}
+
+		_, err = writer.Write(data)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
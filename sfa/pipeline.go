@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+// ArchivePipeline archives files concurrently in several stages: files are
+// split into chunks by readers, chunks are named by hashers, compressed and
+// encrypted by encryptors and stored by a single writer. Archived files are
+// committed to the index in the order in which they were added, so the
+// resulting index does not depend on the number of workers. Files that cannot
+// be archived keep their previous version and are collected in Failed. After
+// maxWriteFailures chunks in a row could not be written, the pipeline stops
+// writing and the remaining files fail, see Stopped.
+type ArchivePipeline struct {
+	Chunks       *ChunkStore
+	Document     *models.Document
+	Failed       []string
+	OutputDir    string
+	ProgressInfo *ProgressInfo
+
+	stopped       uint32
+	writeFailures int
+
+	docLock   sync.Mutex
+	pending   map[string][]*pendingFile
+	chunkName chunkNamer
+	save      <-chan time.Time
+	files     chan *fileJob
+	hashes    chan *chunkJob
+	encrypts  chan *chunkJob
+	writes    chan *chunkJob
+	commits   chan *fileJob
+	finished  chan bool
+}
+
+// maxWriteFailures is the number of chunks in a row that may fail to be
+// written before the archive run is stopped.
+const maxWriteFailures = 10
+
+var errPipelineStopped = errors.New("archiving was stopped because chunks could not be written")
+
+type fileJob struct {
+	archive   ArchiveInfo
+	exists    bool
+	verify    bool
+	unchanged bool
+	hash      string
+	chunkJobs []*chunkJob
+	done      sync.WaitGroup
+	err       error
+	writeErr  error
+}
+
+// pendingFile is a file whose new version was committed while some of its
+// chunks were in a pack that was not written yet. If writing the pack fails,
+// the previous version is restored.
+type pendingFile struct {
+	shortPath string
+	exists    bool
+	size      uint64
+	reverted  bool
+}
+
+type chunkJob struct {
+	file       *fileJob
+	chunkNo    int
+	chunk      models.Chunk
+	data       []byte
+	ciphertext []byte
+}
+
+func newArchivePipeline(
+	doc *models.Document,
+	chunks *ChunkStore,
+	outputDir string,
+	progressInfo *ProgressInfo,
+	save <-chan time.Time,
+	jobs int,
+) *ArchivePipeline {
+
+	pipeline := &ArchivePipeline{
+		Chunks:       chunks,
+		Document:     doc,
+		OutputDir:    outputDir,
+		ProgressInfo: progressInfo,
+
+		pending:   map[string][]*pendingFile{},
+		chunkName: getChunkNamer(doc),
+		save:      save,
+		files:     make(chan *fileJob, jobs),
+		hashes:    make(chan *chunkJob, jobs),
+		encrypts:  make(chan *chunkJob, jobs),
+		writes:    make(chan *chunkJob, jobs),
+		commits:   make(chan *fileJob, jobs*4),
+		finished:  make(chan bool),
+	}
+
+	startWorkers(jobs, pipeline.readFiles, func() { close(pipeline.hashes) })
+	startWorkers(jobs, pipeline.hashChunks, func() { close(pipeline.encrypts) })
+	startWorkers(jobs, pipeline.encryptChunks, func() { close(pipeline.writes) })
+	startWorkers(1, pipeline.writeChunks, func() {})
+
+	go pipeline.commitFiles()
+
+	return pipeline
+}
+
+// AddDirectory stores a directory in the index.
+func (pipeline *ArchivePipeline) AddDirectory(archive *ArchiveInfo, exists bool) {
+	pipeline.docLock.Lock()
+	defer pipeline.docLock.Unlock()
+
+	archiveFile(archive, exists, nil, "")
+}
+
+// AddFile queues a file for archiving. exists must be true if there already
+// is a version of this file in the index. If verify is true, the file is
+// hashed first and only chunked if the hash differs from the stored one. Files
+// without a stored hash are verified to add the hash to the index.
+func (pipeline *ArchivePipeline) AddFile(archive ArchiveInfo, exists bool, verify bool) {
+	job := &fileJob{
+		archive: archive,
+		exists:  exists,
+		verify:  verify,
+	}
+
+	job.done.Add(1)
+
+	pipeline.files <- job
+	pipeline.commits <- job
+}
+
+// Close waits until all queued files are archived and committed.
+func (pipeline *ArchivePipeline) Close() {
+	close(pipeline.files)
+	close(pipeline.commits)
+
+	<-pipeline.finished
+}
+
+// Flush writes the pending pack file and restores the previous versions of
+// the files that use chunks which could not be written. It must be called
+// before the index is saved.
+func (pipeline *ArchivePipeline) Flush() {
+	pipeline.docLock.Lock()
+	defer pipeline.docLock.Unlock()
+
+	pipeline.flush()
+}
+
+// Stopped returns true if the pipeline stopped writing chunks. Files that are
+// added afterwards fail.
+func (pipeline *ArchivePipeline) Stopped() bool {
+	return atomic.LoadUint32(&pipeline.stopped) != 0
+}
+
+// GetFile returns the current index entry for shortPath.
+func (pipeline *ArchivePipeline) GetFile(shortPath string) (models.File, bool) {
+	pipeline.docLock.Lock()
+	defer pipeline.docLock.Unlock()
+
+	file, exists := pipeline.Document.Files[shortPath]
+
+	return file, exists
+}
+
+func (pipeline *ArchivePipeline) commitFile(job *fileJob) {
+	pipeline.docLock.Lock()
+	defer pipeline.docLock.Unlock()
+
+	pipeline.revertFailedFiles()
+
+	if job.err == nil {
+		job.err = job.writeErr
+	}
+
+	if job.err != nil {
+		pipeline.failFile(job.archive.ShortPath, job.err)
+		return
+	}
+
+	chunks := make([]models.Chunk, len(job.chunkJobs))
+
+	for i, chunkJob := range job.chunkJobs {
+		chunks[i] = chunkJob.chunk
+	}
+
+	if job.exists && !job.unchanged && useChecksums() && chunksAreEqual(job.archive.File.Chunks, chunks) {
+		job.unchanged = true
+	}
+
+	if job.unchanged {
+		utils.Trace.Printf("content of %s did not change, updating metadata", job.archive.ShortPath)
+		updateFileMetadata(&job.archive, job.hash)
+		pipeline.ProgressInfo.AddSkipped(job.archive.FileSize)
+	} else {
+		packs, err := pipeline.getPendingPacks(chunks)
+
+		if err != nil {
+			pipeline.failFile(job.archive.ShortPath, err)
+			return
+		}
+
+		if job.exists {
+			addToDeletedFiles(&job.archive)
+		}
+
+		archiveFile(&job.archive, job.exists, chunks, job.hash)
+		pipeline.ProgressInfo.AddProcessed(job.archive.FileSize)
+
+		file := &pendingFile{
+			shortPath: job.archive.ShortPath,
+			exists:    job.exists,
+			size:      job.archive.FileSize,
+		}
+
+		for _, packID := range packs {
+			pipeline.pending[packID] = append(pipeline.pending[packID], file)
+		}
+	}
+
+	select {
+	case <-pipeline.save:
+		utils.Info.Println("doing intermediary index save")
+		pipeline.flush()
+		saveIndex(pipeline.OutputDir, pipeline.Document)
+		utils.Info.Println("continuing archive process")
+	default:
+	}
+}
+
+func (pipeline *ArchivePipeline) commitFiles() {
+	for job := range pipeline.commits {
+		job.done.Wait()
+		pipeline.commitFile(job)
+	}
+
+	close(pipeline.finished)
+}
+
+// failFile reports that shortPath could not be archived. Its previous version,
+// if there is one, stays in the index.
+func (pipeline *ArchivePipeline) failFile(shortPath string, err error) {
+	utils.Error.Printf("error while archiving %s: %s", shortPath, err)
+	pipeline.Failed = append(pipeline.Failed, shortPath)
+}
+
+func (pipeline *ArchivePipeline) flush() {
+	err := pipeline.Chunks.Flush()
+
+	if err != nil {
+		utils.Error.Println(err)
+	}
+
+	pipeline.revertFailedFiles()
+}
+
+// getPendingPacks returns the IDs of the packs that contain chunks and were
+// not written yet. It returns an error if one of the packs could not be
+// written.
+func (pipeline *ArchivePipeline) getPendingPacks(chunks []models.Chunk) ([]string, error) {
+	packs := []string{}
+	seen := map[string]bool{}
+
+	for _, chunk := range chunks {
+		if len(chunk.Pack) == 0 || seen[chunk.Pack] {
+			continue
+		}
+
+		seen[chunk.Pack] = true
+
+		switch pipeline.Chunks.PackStatus(chunk.Pack) {
+		case packFailed:
+			return nil, fmt.Errorf("pack %s could not be written", chunk.Pack)
+		case packPending:
+			packs = append(packs, chunk.Pack)
+		}
+	}
+
+	return packs, nil
+}
+
+// revertFailedFiles restores the previous versions of the committed files
+// that use chunks in packs which could not be written.
+func (pipeline *ArchivePipeline) revertFailedFiles() {
+	for packID, files := range pipeline.pending {
+		switch pipeline.Chunks.PackStatus(packID) {
+		case packPending:
+			continue
+		case packFailed:
+			for _, file := range files {
+				pipeline.revertFile(file, packID)
+			}
+		}
+
+		delete(pipeline.pending, packID)
+	}
+}
+
+func (pipeline *ArchivePipeline) revertFile(file *pendingFile, packID string) {
+	if file.reverted {
+		return
+	}
+
+	file.reverted = true
+	doc := pipeline.Document
+
+	if file.exists {
+		versions := doc.DeletedFiles[file.shortPath]
+		previous := versions[len(versions)-1]
+		previous.DeletedAt = nil
+		doc.Files[file.shortPath] = previous
+
+		if len(versions) == 1 {
+			delete(doc.DeletedFiles, file.shortPath)
+		} else {
+			doc.DeletedFiles[file.shortPath] = versions[:len(versions)-1]
+		}
+	} else {
+		delete(doc.Files, file.shortPath)
+	}
+
+	pipeline.ProgressInfo.RemoveProcessed(file.size)
+	pipeline.failFile(file.shortPath, fmt.Errorf("pack %s could not be written", packID))
+}
+
+func (pipeline *ArchivePipeline) encryptChunks() {
+	for job := range pipeline.encrypts {
+		chunkFilename := job.chunk.Name + EncSuffix
+
+		if pipeline.Chunks.Find(&job.chunk) {
+			utils.Trace.Printf("chunk #%d (%s) of %s seems to already exist\n", job.chunkNo, chunkFilename, job.file.archive.ShortPath)
+		} else {
+			utils.Trace.Printf("writing chunk #%d (%s) of %s\n", job.chunkNo, chunkFilename, job.file.archive.ShortPath)
+
+			plaintext, compression := compressChunk(job.data, pipeline.Document.Compression)
+			job.chunk.Compression = compression
+			job.chunk.Encryption = pipeline.Document.Encryption
+			job.ciphertext = encryptChunk(plaintext, pipeline.Document.Encryption, pipeline.Document.KeyUnencrypted)
+			job.chunk.CiphertextHash = utils.GetHashSum(job.ciphertext)
+		}
+
+		job.data = nil
+		pipeline.writes <- job
+	}
+}
+
+func (pipeline *ArchivePipeline) hashChunks() {
+	for job := range pipeline.hashes {
+		job.chunk = models.Chunk{
+			Name: pipeline.chunkName(job.data),
+			Size: uint64(len(job.data)),
+		}
+
+		pipeline.encrypts <- job
+	}
+}
+
+func (pipeline *ArchivePipeline) readFile(job *fileJob) error {
+	file, err := os.Open(job.archive.FullPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if job.verify {
+		job.hash, err = utils.GetHashSumReader(file)
+
+		if err != nil {
+			return err
+		}
+
+		// Files without a stored hash are only verified if their size and
+		// modification time did not change, so they only need the hash.
+		if job.hash == job.archive.File.Hash || len(job.archive.File.Hash) == 0 {
+			job.unchanged = true
+			return nil
+		}
+
+		_, err = file.Seek(0, io.SeekStart)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	hash := utils.NewHash()
+	chunker := newChunker(io.TeeReader(file, hash), job.archive.FileSize, getChunking(pipeline.Document))
+
+	for {
+		if pipeline.Stopped() {
+			return errPipelineStopped
+		}
+
+		data, err := chunker.Next()
+
+		if err == io.EOF {
+			job.hash = hex.EncodeToString(hash.Sum(nil))
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		chunk := &chunkJob{
+			file:    job,
+			chunkNo: len(job.chunkJobs) + 1,
+			data:    data,
+		}
+
+		job.chunkJobs = append(job.chunkJobs, chunk)
+		job.done.Add(1)
+
+		pipeline.hashes <- chunk
+	}
+}
+
+func (pipeline *ArchivePipeline) readFiles() {
+	for job := range pipeline.files {
+		utils.Trace.Printf("reading chunks of %s\n", job.archive.ShortPath)
+
+		job.err = pipeline.readFile(job)
+		job.done.Done()
+	}
+}
+
+func (pipeline *ArchivePipeline) writeChunks() {
+	for job := range pipeline.writes {
+		// There is only one writer, so writeErr and writeFailures are not
+		// accessed concurrently.
+		if pipeline.Stopped() {
+			job.file.writeErr = errPipelineStopped
+		} else if job.ciphertext != nil && !pipeline.Chunks.Find(&job.chunk) {
+			// Another job may have stored the same chunk in the meantime.
+			pipeline.writeChunk(job)
+		}
+
+		job.ciphertext = nil
+		job.file.done.Done()
+	}
+}
+
+// writeChunk stores the chunk of job. Only the first of several chunks that
+// fail in a row is retried, so that the single writer does not block the
+// pipeline for the full backoff of every chunk until maxWriteFailures is
+// reached.
+func (pipeline *ArchivePipeline) writeChunk(job *chunkJob) {
+	err := pipeline.Chunks.Save(&job.chunk, job.ciphertext)
+
+	if err == nil {
+		if pipeline.writeFailures != 0 {
+			pipeline.Chunks.SetRetries(writeRetries)
+		}
+
+		pipeline.writeFailures = 0
+		return
+	}
+
+	utils.Error.Printf("cannot write chunk #%d of %s: %s", job.chunkNo, job.file.archive.ShortPath, err)
+	job.file.writeErr = err
+	pipeline.writeFailures++
+	pipeline.Chunks.SetRetries(0)
+
+	if pipeline.writeFailures == maxWriteFailures {
+		utils.Error.Printf("%d chunks in a row could not be written, stopping", maxWriteFailures)
+		atomic.StoreUint32(&pipeline.stopped, 1)
+	}
+}
+
+// startWorkers runs worker in count goroutines and calls done once all of
+// them have returned.
+func startWorkers(count int, worker func(), done func()) {
+	var wg sync.WaitGroup
+
+	wg.Add(count)
+
+	for i := 0; i < count; i++ {
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		done()
+	}()
+}
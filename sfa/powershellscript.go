@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/srhnsn/securefilearchiver/models"
+)
+
+const (
+	powerShellScriptFilename  = "restore.ps1"
+	powerShellScriptSeparator = "************************************************************"
+	// dotNetUnixEpochTicks is the number of 100 ns ticks between 0001-01-01
+	// and 1970-01-01, the epoch of .NET's DateTime.
+	dotNetUnixEpochTicks = 621355968000000000
+)
+
+// powerShellScript generates PowerShell scripts. Unlike batch files, they can
+// handle arbitrary Unicode filenames and need no external tools except gpg.
+type powerShellScript struct{}
+
+func (powerShellScript) Filename() string {
+	return powerShellScriptFilename
+}
+
+// Header returns the start of the restore script: settings and the helper
+// functions that are called by the restore commands. The script starts with a
+// byte order mark because Windows PowerShell reads scripts without one in the
+// legacy code page.
+func (powerShellScript) Header() []string {
+	return []string{
+		"\ufeff#Requires -Version 4.0",
+		"",
+		"$ErrorActionPreference = 'Stop'",
+		"Set-Location -LiteralPath $PSScriptRoot",
+		"[Environment]::CurrentDirectory = $PSScriptRoot",
+		"[Console]::OutputEncoding = [Text.Encoding]::UTF8",
+		"",
+		"$gpg = Get-Command gpg2, gpg -CommandType Application -ErrorAction SilentlyContinue | Select-Object -First 1",
+		"$script:mismatches = 0",
+		"",
+		"function Invoke-Tool {",
+		"    $tool, $arguments = $args",
+		"    & $tool @arguments",
+		"    if ($LASTEXITCODE -ne 0) { throw \"$tool failed with exit code $LASTEXITCODE\" }",
+		"}",
+		"",
+		"function Join-Chunks([string[]]$Files, [string]$Dest) {",
+		"    $out = [IO.File]::Create($Dest)",
+		"    try {",
+		"        foreach ($file in $Files) {",
+		"            $in = [IO.File]::OpenRead($file)",
+		"            try { $in.CopyTo($out) } finally { $in.Dispose() }",
+		"        }",
+		"    } finally {",
+		"        $out.Dispose()",
+		"    }",
+		"}",
+		"",
+		"function Copy-Range([string]$Source, [long]$Offset, [long]$Length, [string]$Dest) {",
+		"    $in = [IO.File]::OpenRead($Source)",
+		"    try {",
+		"        $in.Position = $Offset",
+		"        $data = New-Object byte[] $Length",
+		"        $n = 0",
+		"        while ($n -lt $Length) {",
+		"            $r = $in.Read($data, $n, $Length - $n)",
+		"            if ($r -le 0) { throw \"unexpected end of $Source\" }",
+		"            $n += $r",
+		"        }",
+		"    } finally {",
+		"        $in.Dispose()",
+		"    }",
+		"    [IO.File]::WriteAllBytes($Dest, $data)",
+		"}",
+		"",
+		"function Set-ModificationTime([string]$Path, [long]$Ticks) {",
+		"    (Get-Item -LiteralPath $Path -Force).LastWriteTimeUtc = New-Object DateTime $Ticks, ([DateTimeKind]::Utc)",
+		"}",
+		"",
+		"function Test-Checksum([string]$Path, [string]$Hash) {",
+		"    if ((Get-FileHash -LiteralPath $Path -Algorithm SHA256).Hash -ne $Hash) {",
+		"        Write-Host ''",
+		"        Write-Host '" + powerShellScriptSeparator + "'",
+		"        Write-Host \"CHECKSUM MISMATCH: $Path\"",
+		"        Write-Host '" + powerShellScriptSeparator + "'",
+		"        $script:mismatches++",
+		"    }",
+		"}",
+		"",
+		"function Show-Progress([long]$Current, [long]$Total, [string]$Path) {",
+		"    Write-Host \"[$Current/$Total] $Path\"",
+		"}",
+		"",
+	}
+}
+
+func (powerShellScript) Footer() []string {
+	return []string{
+		"if ($script:mismatches -gt 0) {",
+		"    Write-Host ''",
+		"    Write-Host '" + powerShellScriptSeparator + "'",
+		"    Write-Host \"$script:mismatches restored files do not match their checksums!\"",
+		"    Write-Host '" + powerShellScriptSeparator + "'",
+		"    exit 1",
+		"}",
+		"",
+	}
+}
+
+func (powerShellScript) LineEnding() string {
+	return "\r\n"
+}
+
+func (powerShellScript) Concat(files []string, dest string) string {
+	quoted := make([]string, len(files))
+
+	for i, file := range files {
+		quoted[i] = powerShellQuote(file)
+	}
+
+	return fmt.Sprintf(`Join-Chunks @(%s) %s`, strings.Join(quoted, ", "), powerShellQuote(dest))
+}
+
+// Decompress returns a command that decompresses path and removes it. The
+// decompressed file is path without the compression suffix.
+func (powerShellScript) Decompress(compression string, path string) string {
+	if compression == models.CompressionZstd {
+		return fmt.Sprintf(`Invoke-Tool zstd --decompress --quiet --force --rm %s`, powerShellQuote(path))
+	}
+
+	return fmt.Sprintf(`Invoke-Tool gzip --decompress --force %s`, powerShellQuote(path))
+}
+
+// Decrypt returns a command that decrypts the chunk in source to dest.
+func (powerShellScript) Decrypt(chunk models.Chunk, source string, dest string) string {
+	if chunk.Encryption == models.EncryptionHKDF {
+		return fmt.Sprintf(`Invoke-Tool sfa decrypt-chunk --key-file %s %s %s`,
+			powerShellQuote(passwordFile), powerShellQuote(source), powerShellQuote(dest))
+	}
+
+	return fmt.Sprintf(`Invoke-Tool $gpg --batch --yes --decrypt --passphrase-file %s --quiet --output %s %s`,
+		powerShellQuote(passwordFile), powerShellQuote(dest), powerShellQuote(source))
+}
+
+func (powerShellScript) Delete(path string) string {
+	return fmt.Sprintf(`Remove-Item -LiteralPath %s -Force`, powerShellQuote(path))
+}
+
+// Extract returns a command that copies length bytes at offset in the file
+// source to dest.
+func (powerShellScript) Extract(source string, offset uint64, length uint64, dest string) string {
+	return fmt.Sprintf(`Copy-Range %s %d %d %s`, powerShellQuote(source), offset, length, powerShellQuote(dest))
+}
+
+func (powerShellScript) MkDir(dir string) string {
+	return fmt.Sprintf(`[void][IO.Directory]::CreateDirectory(%s)`, powerShellQuote(dir))
+}
+
+func (powerShellScript) Progress(current uint64, total uint64, path string) string {
+	return fmt.Sprintf(`Show-Progress %d %d %s`, current, total, powerShellQuote(path))
+}
+
+// Touch returns a command that sets the modification time of path. The time is
+// given in .NET ticks so that it is restored exactly.
+func (powerShellScript) Touch(path string, mtime time.Time) string {
+	ticks := mtime.UnixNano()/100 + dotNetUnixEpochTicks
+
+	return fmt.Sprintf(`Set-ModificationTime %s %d`, powerShellQuote(path), ticks)
+}
+
+// Verify returns a command that compares the SHA-256 checksum of path with
+// hash and reports a mismatch.
+func (powerShellScript) Verify(path string, hash string) string {
+	return fmt.Sprintf(`Test-Checksum %s '%s'`, powerShellQuote(path), hash)
+}
+
+// CheckPath returns an error if path cannot be used in a PowerShell script.
+// Windows PowerShell does not escape double quotes in the arguments of
+// external programs and backslashes are path separators in PowerShell.
+func (powerShellScript) CheckPath(path string) error {
+	if !utf8.ValidString(path) {
+		return fmt.Errorf("path is not valid UTF-8")
+	}
+
+	if strings.ContainsAny(path, `"\`) {
+		return fmt.Errorf("path contains \" or \\, which cannot be used in a PowerShell script")
+	}
+
+	if strings.ContainsRune(path, 0) {
+		return fmt.Errorf("path contains a NUL character")
+	}
+
+	return nil
+}
+
+// powerShellQuote quotes path as a PowerShell single-quoted string, in which
+// nothing is expanded. PowerShell also treats the typographic single quotes as
+// quote characters, so these are doubled as well. Paths that start with a dash
+// are prefixed with ./ so that they are not mistaken for options.
+func powerShellQuote(path string) string {
+	path = filepath.ToSlash(path)
+
+	if strings.HasPrefix(path, "-") {
+		path = "./" + path
+	}
+
+	var quoted bytes.Buffer
+
+	quoted.WriteByte('\'')
+
+	for _, r := range path {
+		switch r {
+		case '\'', '‘', '’', '‚', '‛':
+			quoted.WriteRune(r)
+		}
+
+		quoted.WriteRune(r)
+	}
+
+	quoted.WriteByte('\'')
+
+	return quoted.String()
+}
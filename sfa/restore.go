@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,60 +10,206 @@ import (
 
 	"github.com/ryanuber/go-glob"
 
+	"github.com/srhnsn/securefilearchiver/backend"
 	"github.com/srhnsn/securefilearchiver/models"
 	"github.com/srhnsn/securefilearchiver/utils"
 )
 
 const (
-	outputScriptfile = "restore.bat"
-	mtimeFormat      = "2006-01-02 15:04:05.999999999 -0700"
-	passwordFile     = "key.txt"
+	packChunkFile   = "pack-chunk.tmp"
+	passwordFile    = "key.txt"
+	scriptFormatBat = "bat"
+	scriptFormatPs1 = "ps1"
+	scriptFormatSh  = "sh"
 )
 
-func getRestoreDirectoryCommands(inputDir string, outputDir string, shortPath string, file models.File) []string {
+// RestoreScript generates the commands of a restore script for a specific
+// shell. Paths are relative to the output directory, in which the script is
+// run, except for the paths of chunks and packs.
+type RestoreScript interface {
+	// Filename returns the filename of the restore script.
+	Filename() string
+	// Header returns the commands at the start of the script.
+	Header() []string
+	// Footer returns the commands at the end of the script.
+	Footer() []string
+	// LineEnding returns the line separator of the script.
+	LineEnding() string
+	// CheckPath returns an error if path cannot be quoted safely in the
+	// script. All other methods expect paths that passed this check.
+	CheckPath(path string) error
+
+	Concat(files []string, dest string) string
+	Decompress(compression string, path string) string
+	Decrypt(chunk models.Chunk, source string, dest string) string
+	Delete(path string) string
+	Extract(source string, offset uint64, length uint64, dest string) string
+	MkDir(dir string) string
+	Progress(current uint64, total uint64, path string) string
+	Touch(path string, mtime time.Time) string
+	Verify(path string, hash string) string
+}
+
+func getRestoreDirectoryCommands(script RestoreScript, inputDir string, shortPath string, file models.File) []string {
 	out := []string{}
 
-	out = append(out, getMkDirCmd(shortPath))
-	out = append(out, getTouchCmd(shortPath, file.ModificationTime.Time))
+	out = append(out, script.MkDir(shortPath))
 
 	return out
 }
 
-func getRestoreFileCommands(inputDir string, outputDir string, shortPath string, file models.File) []string {
+func getRestoreFileCommands(script RestoreScript, inputDir string, shortPath string, file models.File) []string {
 	out := []string{}
 
 	destDir := filepath.Dir(shortPath)
 	filename := filepath.Base(shortPath)
 
-	out = append(out, getMkDirCmd(destDir))
+	out = append(out, script.MkDir(destDir))
 	var chunkCmds []string
 
 	if len(file.Chunks) == 1 {
-		chunkCmds = restoreSingleChunk(inputDir, destDir, filename, file)
+		chunkCmds = restoreSingleChunk(script, inputDir, destDir, filename, file)
 	} else {
-		chunkCmds = restoreMultipleChunks(inputDir, destDir, filename, file)
+		chunkCmds = restoreMultipleChunks(script, inputDir, destDir, filename, file)
 	}
 
 	out = append(out, chunkCmds...)
-	out = append(out, getTouchCmd(filepath.Join(destDir, filename), file.ModificationTime.Time))
+
+	// certutil cannot hash empty files.
+	if len(file.Hash) != 0 && file.Size != 0 {
+		out = append(out, script.Verify(filepath.Join(destDir, filename), file.Hash))
+	}
+
+	out = append(out, script.Touch(filepath.Join(destDir, filename), file.ModificationTime.Time))
 
 	return out
 }
 
-func getRestorePathsCommands(inputDir string, outputDir string, doc *models.Document) ([]string, uint64) {
-	out := []string{}
+// getRestoreScript returns the RestoreScript for format.
+func getRestoreScript(format string) RestoreScript {
+	switch format {
+	case scriptFormatPs1:
+		return powerShellScript{}
+	case scriptFormatSh:
+		return shellScript{}
+	}
 
-	var noFiles uint64
+	return batchScript{}
+}
 
-	sortedKeys := doc.GetSortedFilesKeys()
+// readRestoreIndex reads the index of the archive in inputDir. With --as-of,
+// the files in the index are replaced with the versions that were current at
+// that time. With --path, only a single version of that path is kept.
+func readRestoreIndex(inputDir string) *models.Document {
+	doc, err := readIndex(inputDir)
 
-	for _, shortPath := range sortedKeys {
-		file := doc.Files[shortPath]
+	utils.PanicIfErr(err)
+
+	if len(*restoreAsOf) != 0 && len(*restoreVersion) != 0 {
+		utils.PanicIfErr(fmt.Errorf("--as-of and --version cannot be used together"))
+	}
+
+	if len(*restorePath) == 0 && (len(*restoreVersion) != 0 || len(*restoreOutputName) != 0) {
+		utils.PanicIfErr(fmt.Errorf("--version and --output-name need --path"))
+	}
+
+	if len(*restoreAsOf) != 0 {
+		asOf, err := utils.ParsePointInTime(*restoreAsOf)
+
+		utils.PanicIfErr(err)
+
+		utils.Info.Printf("restoring files as of %s", asOf)
+		doc.Files = doc.GetFilesAt(asOf)
+	}
+
+	if len(*restorePath) != 0 {
+		shortPath := getIndexPath(*restorePath)
+		file, exists := doc.Files[shortPath]
+
+		if len(*restoreAsOf) == 0 {
+			file, err = getVersion(doc, shortPath, *restoreVersion)
+		} else if !exists {
+			err = fmt.Errorf("%s did not exist at %s", shortPath, *restoreAsOf)
+		}
+
+		utils.PanicIfErr(err)
 
+		if len(*restoreOutputName) != 0 {
+			if strings.ContainsAny(*restoreOutputName, `/\`) || *restoreOutputName == "." || *restoreOutputName == ".." {
+				utils.PanicIfErr(fmt.Errorf("--output-name must be a file name without directories: %s", *restoreOutputName))
+			}
+
+			shortPath = *restoreOutputName
+		}
+
+		doc.Files = map[string]models.File{shortPath: file}
+	}
+
+	return doc
+}
+
+// getRestorePaths returns the sorted paths in doc that match the restore
+// pattern.
+func getRestorePaths(doc *models.Document) []string {
+	paths := []string{}
+
+	for _, shortPath := range doc.GetSortedFilesKeys() {
 		if len(*restorePattern) != 0 && len(shortPath) != 0 && !glob.Glob(*restorePattern, shortPath) {
 			continue
 		}
 
+		paths = append(paths, shortPath)
+	}
+
+	return paths
+}
+
+// logUnverifiedFiles logs the files in paths whose content cannot be verified
+// after the restore because the index has no checksum for them.
+func logUnverifiedFiles(doc *models.Document, paths []string) {
+	var unverified uint64
+
+	for _, shortPath := range paths {
+		file := doc.Files[shortPath]
+
+		if !file.IsDirectory && file.Size != 0 && len(file.Hash) == 0 {
+			utils.Trace.Printf("%s has no checksum and is not verified", shortPath)
+			unverified++
+		}
+	}
+
+	if unverified > 0 {
+		utils.Info.Printf("%d files have no checksum and are not verified, archive with --checksum to add the missing checksums", unverified)
+	}
+}
+
+// getRestorePathsCommands returns the restore commands for all paths that
+// match the restore pattern and the paths that were left out because they
+// cannot be used in script.
+func getRestorePathsCommands(script RestoreScript, inputDir string, doc *models.Document) ([]string, uint64, []string) {
+	out := []string{}
+
+	paths := []string{}
+	rejected := []string{}
+	touchDirs := []string{}
+
+	for _, shortPath := range getRestorePaths(doc) {
+		err := script.CheckPath(shortPath)
+
+		if err != nil {
+			utils.Error.Printf("cannot restore %q with %s: %s", shortPath, script.Filename(), err)
+			rejected = append(rejected, shortPath)
+			continue
+		}
+
+		paths = append(paths, shortPath)
+	}
+
+	var noFiles uint64
+
+	for _, shortPath := range paths {
+		file := doc.Files[shortPath]
+
 		noFiles++
 		var cmds []string
 
@@ -70,69 +217,106 @@ func getRestorePathsCommands(inputDir string, outputDir string, doc *models.Docu
 			shortPath = "."
 		}
 
+		out = append(out, script.Progress(noFiles, uint64(len(paths)), shortPath))
+
 		if file.IsDirectory {
-			cmds = getRestoreDirectoryCommands(inputDir, outputDir, shortPath, file)
+			cmds = getRestoreDirectoryCommands(script, inputDir, shortPath, file)
+			touchDirs = append(touchDirs, script.Touch(shortPath, file.ModificationTime.Time))
 		} else {
-			cmds = getRestoreFileCommands(inputDir, outputDir, shortPath, file)
+			cmds = getRestoreFileCommands(script, inputDir, shortPath, file)
 		}
 
 		out = append(out, cmds...)
 		out = append(out, "")
 	}
 
-	return out, noFiles
+	// Directory modification times change while their content is restored,
+	// so they are set last, deepest directories first.
+	for i := len(touchDirs) - 1; i >= 0; i-- {
+		out = append(out, touchDirs[i])
+	}
+
+	out = append(out, "")
+
+	return out, noFiles, rejected
 }
 
-func restoreFiles(inputDir string, outputDir string) {
-	doc, err := readIndex(getExistingIndexFilename(inputDir))
+// decryptChunkFile decrypts a chunk that was encrypted with a derived key. It
+// is used by restore scripts as GnuPG cannot decrypt these chunks.
+func decryptChunkFile(inputFile string, outputFile string, keyFile string) {
+	key, err := ioutil.ReadFile(keyFile)
 
 	utils.PanicIfErr(err)
 
+	data, err := ioutil.ReadFile(inputFile)
+
+	utils.PanicIfErr(err)
+
+	data, err = utils.DecryptDataWithDerivedKey(data, strings.TrimSpace(string(key)))
+
+	utils.PanicIfErr(err)
+
+	utils.MustWriteFile(outputFile, data)
+}
+
+func restoreFiles(inputDir string, outputDir string) {
+	// The restore scripts read the chunk files directly.
+	if backend.IsURL(inputDir) {
+		utils.PanicIfErr(fmt.Errorf("restore scripts need an archive in a local directory, use --native"))
+	}
+
+	doc := readRestoreIndex(inputDir)
+
 	if len(*restorePattern) != 0 {
 		utils.Info.Printf("using restore pattern %s", *restorePattern)
 	}
 
-	out := []string{
-		"@echo off",
-		"",
-		"chcp 65001 >NUL",
-		"",
+	script := getRestoreScript(*restoreScriptFormat)
+	err := script.CheckPath(inputDir[len(filepath.VolumeName(inputDir)):])
+
+	if err != nil {
+		utils.PanicIfErr(fmt.Errorf("source directory cannot be used in %s: %s", script.Filename(), err))
 	}
 
-	restoreCommands, noFiles := getRestorePathsCommands(inputDir, outputDir, doc)
+	out := script.Header()
+
+	restoreCommands, noFiles, rejected := getRestorePathsCommands(script, inputDir, doc)
 	out = append(out, restoreCommands...)
+	logUnverifiedFiles(doc, getRestorePaths(doc))
 
-	if len(*restorePattern) == 0 {
+	if noFiles == uint64(len(doc.Files)) {
 		utils.Info.Printf("restored %d files", len(doc.Files))
 	} else {
 		utils.Info.Printf("restored %d out of %d files", noFiles, len(doc.Files))
 	}
 
-	out = append(out, "pause")
+	out = append(out, script.Footer()...)
 	err = os.MkdirAll(outputDir, 0700)
 
 	utils.PanicIfErr(err)
 
-	data := []byte(strings.Join(out, "\r\n"))
-	utils.MustWriteFile(filepath.Join(outputDir, outputScriptfile), data)
+	data := []byte(strings.Join(out, script.LineEnding()))
+	utils.MustWriteFile(filepath.Join(outputDir, script.Filename()), data)
 
 	utils.MustWriteFile(filepath.Join(outputDir, passwordFile), []byte(doc.KeyUnencrypted))
+
+	if len(rejected) > 0 {
+		utils.Error.Printf("%d paths were left out of %s, restore them with another --script-format or with --native", len(rejected), script.Filename())
+		os.Exit(1)
+	}
 }
 
-func restoreSingleChunk(inputDir string, destDir string, filename string, file models.File) []string {
+func restoreSingleChunk(script RestoreScript, inputDir string, destDir string, filename string, file models.File) []string {
 	out := []string{}
 
-	chunk := file.Chunks[0]
-	chunkSource := filepath.Join(inputDir, chunk.Name[0:2], chunk.Name[0:4], chunk.Name+EncSuffix)
 	chunkDest := filepath.Join(destDir, filename)
 
-	cmd := utils.GetDecryptCommand(chunkSource, chunkDest, passwordFile)
-	out = append(out, cmd)
+	out = append(out, getDecryptChunkCommands(script, inputDir, file.Chunks[0], chunkDest)...)
 
 	return out
 }
 
-func restoreMultipleChunks(inputDir string, destDir string, filename string, file models.File) []string {
+func restoreMultipleChunks(script RestoreScript, inputDir string, destDir string, filename string, file models.File) []string {
 	out := []string{}
 
 	fileDest := filepath.Join(destDir, filename)
@@ -140,42 +324,52 @@ func restoreMultipleChunks(inputDir string, destDir string, filename string, fil
 	delList := []string{}
 
 	for chunkNo, chunk := range file.Chunks {
-		chunkSource := filepath.Join(inputDir, chunk.Name[0:2], chunk.Name[0:4], chunk.Name+EncSuffix)
 		chunkDest := filepath.Join(destDir, fmt.Sprintf("%s.%d", filename, chunkNo+1))
 
-		cmd := utils.GetDecryptCommand(chunkSource, chunkDest, passwordFile)
-
-		out = append(out, cmd)
+		out = append(out, getDecryptChunkCommands(script, inputDir, chunk, chunkDest)...)
 		concatList = append(concatList, chunkDest)
-		delList = append(delList, getDeleteCmd(chunkDest))
+		delList = append(delList, script.Delete(chunkDest))
 	}
 
-	out = append(out, getConcatCmd(concatList, fileDest))
+	out = append(out, script.Concat(concatList, fileDest))
 	out = append(out, delList...)
 
 	return out
 }
 
-func getConcatCmd(files []string, dest string) string {
-	return fmt.Sprintf(
-		`copy /B /Y "%s" "%s" >NUL`,
-		strings.Join(files, `"+"`),
-		dest,
-	)
-}
+// getDecryptChunkCommands returns the commands to decrypt chunk to dest. Chunks
+// in pack files are first extracted to a temporary file, compressed chunks are
+// decompressed after decryption.
+func getDecryptChunkCommands(script RestoreScript, inputDir string, chunk models.Chunk, dest string) []string {
+	out := []string{}
+	source := getChunkPath(inputDir, chunk.Name)
+	decryptDest := dest + getCompressionSuffix(chunk.Compression)
 
-func getDeleteCmd(path string) string {
-	return fmt.Sprintf(`del "%s"`, path)
-}
+	if len(chunk.Pack) != 0 {
+		source = packChunkFile
+		out = append(out, script.Extract(getPackPath(inputDir, chunk.Pack), chunk.Offset, chunk.Length, source))
+	}
+
+	out = append(out, script.Decrypt(chunk, source, decryptDest))
+
+	if len(chunk.Pack) != 0 {
+		out = append(out, script.Delete(source))
+	}
 
-func getMkDirCmd(dir string) string {
-	return fmt.Sprintf(`mkdir "%s" >NUL 2>&1`, dir)
+	if len(chunk.Compression) != 0 {
+		out = append(out, script.Decompress(chunk.Compression, decryptDest))
+	}
+
+	return out
 }
 
-func getTouchCmd(path string, mtime time.Time) string {
-	return fmt.Sprintf(
-		`call touch -d "%s" "%s"`,
-		mtime.Format(mtimeFormat),
-		path,
-	)
+func getCompressionSuffix(compression string) string {
+	switch compression {
+	case models.CompressionGzip:
+		return ZipSuffix
+	case models.CompressionZstd:
+		return ZstdSuffix
+	}
+
+	return ""
 }
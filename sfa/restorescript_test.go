@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// FuzzRestoreScriptQuoting checks that every path is either rejected by
+// CheckPath or quoted so that the shell of the script sees exactly the path.
+// Batch files and PowerShell scripts are only run where cmd.exe and pwsh are
+// available; elsewhere the batch quoting is checked by undoing it.
+func FuzzRestoreScriptQuoting(f *testing.F) {
+	seeds := []string{
+		"",
+		"file.txt",
+		"dir/file with spaces.txt",
+		"it's",
+		`say "hi"`,
+		"‘typographic’ ‚quotes‛",
+		"100%",
+		"%PATH%",
+		"%%",
+		"%~dp0",
+		"!PATH!",
+		"wow!",
+		"$(id)",
+		"${HOME}",
+		"$HOME",
+		"`id`",
+		"a\nb",
+		"a\r\nb",
+		"a;b",
+		"a&b",
+		"a|b",
+		"a && b",
+		"-rf",
+		"--help",
+		"-",
+		"caret^",
+		"back\\slash",
+		"tab\there",
+		"nul\x00byte",
+		"\xff\xfe",
+		"日本語/ファイル",
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	shPath, shErr := exec.LookPath("sh")
+	pwshPath, pwshErr := exec.LookPath("pwsh")
+
+	f.Fuzz(func(t *testing.T, path string) {
+		if (shellScript{}).CheckPath(path) == nil && shErr == nil {
+			checkShellRoundTrip(t, shPath, path)
+		}
+
+		if (batchScript{}).CheckPath(path) == nil {
+			checkBatchQuoting(t, path)
+
+			if runtime.GOOS == "windows" {
+				checkBatchRoundTrip(t, path)
+			}
+		}
+
+		if (powerShellScript{}).CheckPath(path) == nil && pwshErr == nil {
+			checkPowerShellRoundTrip(t, pwshPath, path)
+		}
+	})
+}
+
+// expectedQuotedPath returns path as the quoting functions pass it to the
+// shell: with forward slashes and with ./ before a leading dash.
+func expectedQuotedPath(path string) string {
+	path = filepath.ToSlash(path)
+
+	if strings.HasPrefix(path, "-") {
+		path = "./" + path
+	}
+
+	return path
+}
+
+func checkShellRoundTrip(t *testing.T, sh string, path string) {
+	out, err := exec.Command(sh, "-c", "printf '%s' "+shellQuote(path)).Output()
+
+	if err != nil {
+		t.Fatalf("sh failed for %q: %s", path, err)
+	}
+
+	if expected := expectedQuotedPath(path); string(out) != expected {
+		t.Fatalf("sh quoting of %q: got %q, want %q", path, out, expected)
+	}
+}
+
+func checkPowerShellRoundTrip(t *testing.T, pwsh string, path string) {
+	command := "[Console]::OutputEncoding = [Text.Encoding]::UTF8; [Console]::Out.Write(" + powerShellQuote(path) + ")"
+	encoded := utf16.Encode([]rune(command))
+	data := make([]byte, 2*len(encoded))
+
+	for i, c := range encoded {
+		data[2*i] = byte(c)
+		data[2*i+1] = byte(c >> 8)
+	}
+
+	out, err := exec.Command(pwsh, "-NoProfile", "-NonInteractive", "-EncodedCommand", base64.StdEncoding.EncodeToString(data)).Output()
+
+	if err != nil {
+		t.Fatalf("pwsh failed for %q: %s", path, err)
+	}
+
+	if expected := expectedQuotedPath(path); string(out) != expected {
+		t.Fatalf("PowerShell quoting of %q: got %q, want %q", path, out, expected)
+	}
+}
+
+// checkBatchQuoting undoes the percent sign escaping of batchQuote and
+// batchCallQuote the way cmd.exe does and compares the result with path.
+func checkBatchQuoting(t *testing.T, path string) {
+	if !utf8.ValidString(path) {
+		t.Fatalf("batch CheckPath accepted invalid UTF-8 %q", path)
+	}
+
+	for _, quote := range []struct {
+		name       string
+		quoted     string
+		expansions int
+	}{
+		{"batchQuote", batchQuote(path), 1},
+		{"batchCallQuote", batchCallQuote(path), 2},
+	} {
+		inner := strings.TrimSuffix(strings.TrimPrefix(quote.quoted, `"`), `"`)
+
+		if len(inner) != len(quote.quoted)-2 || strings.Contains(inner, `"`) {
+			t.Fatalf("%s(%q) = %s is not a single quoted string", quote.name, path, quote.quoted)
+		}
+
+		for i := 0; i < quote.expansions; i++ {
+			var err error
+			inner, err = batchExpandPercent(inner)
+
+			if err != nil {
+				t.Fatalf("%s(%q) = %s: %s", quote.name, path, quote.quoted, err)
+			}
+		}
+
+		if inner != path {
+			t.Fatalf("%s(%q) is %q after expansion", quote.name, path, inner)
+		}
+	}
+}
+
+// batchExpandPercent turns %% into % and fails on any other percent sign,
+// which cmd.exe would treat as the start of a variable.
+func batchExpandPercent(s string) (string, error) {
+	var out bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		if i+1 == len(s) || s[i+1] != '%' {
+			return "", fmt.Errorf("unescaped %% at offset %d", i)
+		}
+
+		out.WriteByte('%')
+		i++
+	}
+
+	return out.String(), nil
+}
+
+// checkBatchRoundTrip runs a batch file that echoes the quoted path with and
+// without call, using the header of the restore script.
+func checkBatchRoundTrip(t *testing.T, path string) {
+	script := batchScript{}
+	lines := append(script.Header(),
+		"echo "+batchQuote(path),
+		"call echo "+batchCallQuote(path),
+	)
+
+	filename := filepath.Join(t.TempDir(), script.Filename())
+	err := os.WriteFile(filename, []byte(strings.Join(lines, script.LineEnding())), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("cmd.exe", "/D", "/V:ON", "/C", filename).Output()
+
+	if err != nil {
+		t.Fatalf("cmd.exe failed for %q: %s", path, err)
+	}
+
+	expected := strings.Repeat(`"`+path+`"`+script.LineEnding(), 2)
+
+	if string(out) != expected {
+		t.Fatalf("batch quoting of %q: got %q, want %q", path, out, expected)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/srhnsn/securefilearchiver/models"
+)
+
+const (
+	shellMtimeFormat     = "2006-01-02T15:04:05.999999999Z"
+	shellScriptFilename  = "restore.sh"
+	shellScriptSeparator = "************************************************************"
+)
+
+// shellScript generates POSIX shell scripts for Linux and macOS.
+type shellScript struct{}
+
+func (shellScript) Filename() string {
+	return shellScriptFilename
+}
+
+func (shellScript) Header() []string {
+	return []string{
+		"#!/bin/sh",
+		"",
+		"set -eu",
+		`cd "$(dirname "$0")"`,
+		"",
+		"if command -v gpg2 >/dev/null 2>&1; then",
+		"    GPG=gpg2",
+		"else",
+		"    GPG=gpg",
+		"fi",
+		"",
+		"mismatches=0",
+		"",
+		"mismatch() {",
+		"    echo",
+		"    echo '" + shellScriptSeparator + "'",
+		`    printf 'CHECKSUM MISMATCH: %s\n' "$1"`,
+		"    echo '" + shellScriptSeparator + "'",
+		"    mismatches=$((mismatches + 1))",
+		"}",
+		"",
+		"progress() {",
+		`    printf '[%s/%s] %s\n' "$1" "$2" "$3"`,
+		"}",
+		"",
+		"sha256() {",
+		"    if command -v sha256sum >/dev/null 2>&1; then",
+		`        sha256sum < "$1" | cut -d ' ' -f 1`,
+		"    else",
+		`        shasum -a 256 < "$1" | cut -d ' ' -f 1`,
+		"    fi",
+		"}",
+		"",
+	}
+}
+
+func (shellScript) Footer() []string {
+	return []string{
+		`if [ "$mismatches" -gt 0 ]; then`,
+		"    echo",
+		"    echo '" + shellScriptSeparator + "'",
+		`    echo "$mismatches restored files do not match their checksums!"`,
+		"    echo '" + shellScriptSeparator + "'",
+		"    exit 1",
+		"fi",
+		"",
+	}
+}
+
+func (shellScript) LineEnding() string {
+	return "\n"
+}
+
+func (shellScript) Concat(files []string, dest string) string {
+	if len(files) == 0 {
+		return fmt.Sprintf(`: > %s`, shellQuote(dest))
+	}
+
+	quoted := make([]string, len(files))
+
+	for i, file := range files {
+		quoted[i] = shellQuote(file)
+	}
+
+	return fmt.Sprintf(`cat %s > %s`, strings.Join(quoted, " "), shellQuote(dest))
+}
+
+// Decompress returns a command that decompresses path and removes it. The
+// decompressed file is path without the compression suffix.
+func (shellScript) Decompress(compression string, path string) string {
+	if compression == models.CompressionZstd {
+		return fmt.Sprintf(`zstd --decompress --quiet --force --rm %s`, shellQuote(path))
+	}
+
+	return fmt.Sprintf(`gzip --decompress --force %s`, shellQuote(path))
+}
+
+// Decrypt returns a command that decrypts the chunk in source to dest.
+func (shellScript) Decrypt(chunk models.Chunk, source string, dest string) string {
+	if chunk.Encryption == models.EncryptionHKDF {
+		return fmt.Sprintf(`sfa decrypt-chunk --key-file %s %s %s`, shellQuote(passwordFile), shellQuote(source), shellQuote(dest))
+	}
+
+	return fmt.Sprintf(`"$GPG" --batch --yes --decrypt --passphrase-file %s --quiet --output %s %s`,
+		shellQuote(passwordFile), shellQuote(dest), shellQuote(source))
+}
+
+func (shellScript) Delete(path string) string {
+	return fmt.Sprintf(`rm -f %s`, shellQuote(path))
+}
+
+// Extract returns a command that copies length bytes at offset in the file
+// source to dest.
+func (shellScript) Extract(source string, offset uint64, length uint64, dest string) string {
+	return fmt.Sprintf(`tail -c +%d %s | head -c %d > %s`, offset+1, shellQuote(source), length, shellQuote(dest))
+}
+
+func (shellScript) MkDir(dir string) string {
+	return fmt.Sprintf(`mkdir -p %s`, shellQuote(dir))
+}
+
+func (shellScript) Progress(current uint64, total uint64, path string) string {
+	return fmt.Sprintf(`progress %d %d %s`, current, total, shellQuote(path))
+}
+
+// Touch returns a command that sets the modification time of path. The time is
+// given in UTC in a format that both GNU and BSD touch understand.
+func (shellScript) Touch(path string, mtime time.Time) string {
+	return fmt.Sprintf(`touch -d %s %s`, mtime.UTC().Format(shellMtimeFormat), shellQuote(path))
+}
+
+// Verify returns a command that compares the SHA-256 checksum of path with
+// hash and reports a mismatch.
+func (shellScript) Verify(path string, hash string) string {
+	return fmt.Sprintf(`[ "$(sha256 %s)" = %s ] || mismatch %s`, shellQuote(path), hash, shellQuote(path))
+}
+
+// CheckPath returns an error if path contains a NUL character, which cannot be
+// part of a shell word. shellQuote can quote all other paths.
+func (shellScript) CheckPath(path string) error {
+	if strings.ContainsRune(path, 0) {
+		return fmt.Errorf("path contains a NUL character")
+	}
+
+	return nil
+}
+
+// shellQuote quotes path for POSIX shells. Paths that start with a dash are
+// prefixed with ./ so that they are not mistaken for options.
+func shellQuote(path string) string {
+	path = filepath.ToSlash(path)
+
+	if strings.HasPrefix(path, "-") {
+		path = "./" + path
+	}
+
+	return "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
+}
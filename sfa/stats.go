@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const (
+	minHistogramChunkSize = 4 * 1024
+	statsLargestEntries   = 10
+)
+
+// ArchiveStats holds the statistics of an archive. LogicalSize is the size
+// of all current files, HistorySize includes all old versions. StoredSize is
+// the size of all chunk and pack files in the archive directory.
+type ArchiveStats struct {
+	Files              uint64              `json:"files"`
+	Directories        uint64              `json:"directories"`
+	DeletedPaths       uint64              `json:"deleted_paths"`
+	OldVersions        uint64              `json:"old_versions"`
+	LogicalSize        uint64              `json:"logical_size"`
+	HistorySize        uint64              `json:"history_size"`
+	StoredSize         uint64              `json:"stored_size"`
+	UniqueChunks       uint64              `json:"unique_chunks"`
+	UniqueChunkData    uint64              `json:"unique_chunk_data"`
+	DedupRatio         float64             `json:"dedup_ratio"`
+	ChunkSizes         []HistogramBucket   `json:"chunk_sizes"`
+	OrphanedFiles      uint64              `json:"orphaned_files"`
+	MissingChunks      uint64              `json:"missing_chunks"`
+	LargestFiles       []PathSize          `json:"largest_files"`
+	LargestDirectories []PathSize          `json:"largest_directories"`
+	Runs               []models.ArchiveRun `json:"runs"`
+}
+
+// HistogramBucket counts the unique chunks with a size of at most MaxSize
+// bytes that are larger than the previous bucket.
+type HistogramBucket struct {
+	MaxSize uint64 `json:"max_size"`
+	Chunks  uint64 `json:"chunks"`
+}
+
+// PathSize is a file or directory and its size.
+type PathSize struct {
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+}
+
+// PathSizes sorts PathSize values by size, largest first.
+type PathSizes []PathSize
+
+func (sizes PathSizes) Len() int {
+	return len(sizes)
+}
+
+func (sizes PathSizes) Less(i, j int) bool {
+	if sizes[i].Size != sizes[j].Size {
+		return sizes[i].Size > sizes[j].Size
+	}
+
+	return sizes[i].Path < sizes[j].Path
+}
+
+func (sizes PathSizes) Swap(i, j int) {
+	sizes[i], sizes[j] = sizes[j], sizes[i]
+}
+
+// showStats prints the statistics of the archive in inputDir.
+func showStats(inputDir string, asJSON bool) {
+	doc, err := readIndex(inputDir)
+
+	utils.PanicIfErr(err)
+
+	stats := getArchiveStats(doc, scanChunkFiles(inputDir))
+
+	if asJSON {
+		data, err := json.MarshalIndent(stats, "", "  ")
+
+		utils.PanicIfErr(err)
+
+		fmt.Println(string(data))
+		return
+	}
+
+	printArchiveStats(stats)
+}
+
+// getArchiveStats computes the statistics of doc. chunkFiles are the chunk and
+// pack files in the archive directory.
+func getArchiveStats(doc *models.Document, chunkFiles map[string]ChunkFile) ArchiveStats {
+	stats := ArchiveStats{
+		Runs: doc.Runs,
+	}
+
+	files := PathSizes{}
+	directories := map[string]uint64{}
+
+	for shortPath, file := range doc.Files {
+		if file.IsDirectory {
+			stats.Directories++
+			continue
+		}
+
+		stats.Files++
+		stats.LogicalSize += file.Size
+		files = append(files, PathSize{Path: shortPath, Size: file.Size})
+
+		for parent := getParentPath(shortPath); len(parent) != 0; parent = getParentPath(parent) {
+			directories[parent] += file.Size
+		}
+	}
+
+	for shortPath, versions := range doc.DeletedFiles {
+		if _, exists := doc.Files[shortPath]; !exists {
+			stats.DeletedPaths++
+		}
+
+		stats.OldVersions += uint64(len(versions))
+	}
+
+	chunkSizes := map[string]uint64{}
+	missing := map[string]bool{}
+
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		stats.HistorySize += chunk.Size
+		chunkSizes[chunk.Name] = chunk.Size
+
+		location := chunk.Name
+
+		if len(chunk.Pack) != 0 {
+			location = chunk.Pack
+		}
+
+		if _, exists := chunkFiles[location]; !exists {
+			missing[chunk.Name] = true
+		}
+	})
+
+	stats.UniqueChunks = uint64(len(chunkSizes))
+	stats.MissingChunks = uint64(len(missing))
+	stats.ChunkSizes = getChunkSizeHistogram(chunkSizes)
+
+	for _, size := range chunkSizes {
+		stats.UniqueChunkData += size
+	}
+
+	if stats.UniqueChunkData != 0 {
+		stats.DedupRatio = float64(stats.HistorySize) / float64(stats.UniqueChunkData)
+	}
+
+	chunkIndex := getChunkIndexMap(doc)
+
+	for name, chunkFile := range chunkFiles {
+		stats.StoredSize += chunkFile.Size
+
+		if !chunkIndex[name] {
+			stats.OrphanedFiles++
+		}
+	}
+
+	largestDirectories := PathSizes{}
+
+	for shortPath, size := range directories {
+		largestDirectories = append(largestDirectories, PathSize{Path: shortPath, Size: size})
+	}
+
+	stats.LargestFiles = getLargest(files)
+	stats.LargestDirectories = getLargest(largestDirectories)
+
+	return stats
+}
+
+// getChunkSizeHistogram counts the chunks in buckets whose maximum sizes are
+// powers of two.
+func getChunkSizeHistogram(chunkSizes map[string]uint64) []HistogramBucket {
+	counts := map[uint64]uint64{}
+
+	for _, size := range chunkSizes {
+		maxSize := uint64(minHistogramChunkSize)
+
+		for maxSize < size {
+			maxSize *= 2
+		}
+
+		counts[maxSize]++
+	}
+
+	histogram := []HistogramBucket{}
+
+	if len(counts) == 0 {
+		return histogram
+	}
+
+	var largest uint64
+
+	for maxSize := range counts {
+		if maxSize > largest {
+			largest = maxSize
+		}
+	}
+
+	for maxSize := uint64(minHistogramChunkSize); maxSize <= largest; maxSize *= 2 {
+		histogram = append(histogram, HistogramBucket{MaxSize: maxSize, Chunks: counts[maxSize]})
+	}
+
+	return histogram
+}
+
+func getLargest(sizes PathSizes) []PathSize {
+	sort.Sort(sizes)
+
+	if len(sizes) > statsLargestEntries {
+		sizes = sizes[:statsLargestEntries]
+	}
+
+	return sizes
+}
+
+func printArchiveStats(stats ArchiveStats) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(writer, "Files:\t%d\n", stats.Files)
+	fmt.Fprintf(writer, "Directories:\t%d\n", stats.Directories)
+	fmt.Fprintf(writer, "Deleted paths:\t%d\n", stats.DeletedPaths)
+	fmt.Fprintf(writer, "Old versions:\t%d\n", stats.OldVersions)
+	fmt.Fprintf(writer, "Logical size:\t%s\n", utils.FormatFileSize(stats.LogicalSize))
+	fmt.Fprintf(writer, "Size with old versions:\t%s\n", utils.FormatFileSize(stats.HistorySize))
+	fmt.Fprintf(writer, "Stored size:\t%s\n", utils.FormatFileSize(stats.StoredSize))
+	fmt.Fprintf(writer, "Unique chunks:\t%d (%s)\n", stats.UniqueChunks, utils.FormatFileSize(stats.UniqueChunkData))
+	fmt.Fprintf(writer, "Dedup ratio:\t%.2f\n", stats.DedupRatio)
+	fmt.Fprintf(writer, "Orphaned chunk files:\t%d\n", stats.OrphanedFiles)
+	fmt.Fprintf(writer, "Missing chunks:\t%d\n", stats.MissingChunks)
+	writer.Flush()
+
+	fmt.Println()
+	fmt.Println("Chunk sizes:")
+
+	for _, bucket := range stats.ChunkSizes {
+		fmt.Fprintf(writer, "  <= %s\t%d\t\n", utils.FormatFileSize(bucket.MaxSize), bucket.Chunks)
+	}
+
+	writer.Flush()
+
+	printPathSizes("Largest files:", stats.LargestFiles)
+	printPathSizes("Largest directories:", stats.LargestDirectories)
+
+	fmt.Println()
+	fmt.Println("Archive runs:")
+
+	if len(stats.Runs) == 0 {
+		fmt.Println("  none recorded")
+		return
+	}
+
+	writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintln(writer, "Start\tDuration\tProcessed files\tProcessed data\tSkipped files\tDeleted files\tNew chunks\tStored data\t")
+
+	for _, run := range stats.Runs {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%d\t%d\t%d\t%s\t\n",
+			run.Start.Local().Format(displayTimeFormat),
+			run.End.Sub(run.Start.Time).Round(time.Second),
+			run.ProcessedFiles,
+			utils.FormatFileSize(run.ProcessedData),
+			run.SkippedFiles,
+			run.DeletedFiles,
+			run.NewChunks,
+			utils.FormatFileSize(run.StoredData),
+		)
+	}
+
+	writer.Flush()
+}
+
+func printPathSizes(title string, sizes []PathSize) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Println()
+	fmt.Println(title)
+
+	for _, size := range sizes {
+		fmt.Fprintf(writer, "  %s\t%s\n", utils.FormatFileSize(size.Size), size.Path)
+	}
+
+	writer.Flush()
+}
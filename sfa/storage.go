@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/srhnsn/securefilearchiver/backend"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const (
+	writeRetries    = 5
+	writeRetryDelay = time.Second
+)
+
+var (
+	backends     = map[string]backend.Backend{}
+	backendsLock sync.Mutex
+)
+
+// getBackend returns the backend of the archive at location, a local
+// directory or a backend URL. Backends are opened on first use.
+func getBackend(location string) backend.Backend {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	store, exists := backends[location]
+
+	if exists {
+		return store
+	}
+
+	store, err := backend.Open(location)
+
+	utils.PanicIfErr(err)
+
+	backends[location] = store
+
+	return store
+}
+
+// closeBackends closes the connections of all backends that were opened.
+func closeBackends() {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	for location, store := range backends {
+		err := store.Close()
+
+		if err != nil {
+			utils.Error.Printf("cannot close %s: %s", backend.Redact(location), err)
+		}
+
+		delete(backends, location)
+	}
+}
+
+// archiveFileExists returns true if name exists in the archive at location.
+// Errors other than a missing file are fatal, so that an archive that cannot
+// be reached is not mistaken for an empty one.
+func archiveFileExists(location string, name string) bool {
+	_, err := getBackend(location).Stat(name)
+
+	if os.IsNotExist(err) {
+		return false
+	}
+
+	utils.PanicIfErr(err)
+
+	return true
+}
+
+// putWithRetry stores data as name in the archive at location. Failed writes
+// are retried with exponential backoff, as network backends in particular
+// fail temporarily. Errors that retrying does not resolve, like a full disk, a
+// missing permission or a rejected request, are returned immediately.
+func putWithRetry(location string, name string, data []byte) error {
+	return putWithRetries(location, name, data, writeRetries)
+}
+
+// putWithRetries is putWithRetry with retries instead of writeRetries
+// retries.
+func putWithRetries(location string, name string, data []byte, retries int) error {
+	delay := writeRetryDelay
+	err := getBackend(location).Put(name, data)
+
+	for retry := 1; err != nil && retry <= retries && !backend.IsPermanent(err); retry++ {
+		utils.Error.Printf("cannot write %s, retrying in %s (%d/%d): %s", name, delay, retry, retries, err)
+		time.Sleep(delay)
+		delay *= 2
+
+		err = getBackend(location).Put(name, data)
+	}
+
+	return err
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/srhnsn/securefilearchiver/backend"
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const (
+	compressionNone         = "none"
+	defaultPackChunkMaxSize = 1024 * 1024
+	minPackSize             = 1024 * 1024
+	packDirectory           = "packs"
+)
+
+// Pack states, see ChunkStore.PackStatus.
+const (
+	packWritten = iota
+	packPending
+	packFailed
+)
+
+// ChunkStore writes encrypted chunks to the output directory, either as
+// separate files or appended to pack files, and remembers where they are.
+// It is safe for concurrent use. The counters must only be accessed
+// atomically. Failed writes are retried, see SetRetries.
+type ChunkStore struct {
+	SavedChunks uint64
+	SavedData   uint64
+	retries     int32
+	OutputDir   string
+	Packing     *models.Packing
+	locations   map[string]models.Chunk
+	failedPacks map[string]bool
+	lock        sync.RWMutex
+	pack        *pendingPack
+	packLock    sync.Mutex
+}
+
+// ChunkFile is a chunk or pack file in an archive. Path is relative to the
+// archive and uses slashes.
+type ChunkFile struct {
+	Path string
+	Size uint64
+}
+
+type pendingPack struct {
+	id     string
+	chunks []string
+	data   bytes.Buffer
+}
+
+func newChunkStore(outputDir string, doc *models.Document) *ChunkStore {
+	store := &ChunkStore{
+		OutputDir:   outputDir,
+		Packing:     doc.Packing,
+		locations:   map[string]models.Chunk{},
+		failedPacks: map[string]bool{},
+		retries:     writeRetries,
+	}
+
+	doc.ForEachChunk(func(chunk *models.Chunk) {
+		store.locations[chunk.Name] = *chunk
+	})
+
+	return store
+}
+
+// SetRetries sets how often failed writes of chunk and pack files are
+// retried (writeRetries by default).
+func (store *ChunkStore) SetRetries(retries int) {
+	atomic.StoreInt32(&store.retries, int32(retries))
+}
+
+func (store *ChunkStore) getRetries() int {
+	return int(atomic.LoadInt32(&store.retries))
+}
+
+// Find checks if chunk is already stored. If it is, the location of the stored
+// chunk is copied to chunk. Chunk files that are not referenced in the index
+// are not reused as it is unknown how they were compressed.
+func (store *ChunkStore) Find(chunk *models.Chunk) bool {
+	store.lock.RLock()
+	location, exists := store.locations[chunk.Name]
+	store.lock.RUnlock()
+
+	if exists {
+		setChunkLocation(chunk, location)
+	}
+
+	return exists
+}
+
+// Flush writes the pending pack file, if there is one. It must be called
+// before the index is saved. If the pack cannot be written, the files that use
+// its chunks must not be saved in the index, see PackStatus.
+func (store *ChunkStore) Flush() error {
+	store.packLock.Lock()
+	defer store.packLock.Unlock()
+
+	return store.flush()
+}
+
+// PackStatus returns whether the pack packID was written, is still pending or
+// could not be written. Packs that were not created by this store count as
+// written.
+func (store *ChunkStore) PackStatus(packID string) int {
+	store.packLock.Lock()
+	defer store.packLock.Unlock()
+
+	if store.pack != nil && store.pack.id == packID {
+		return packPending
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	if store.failedPacks[packID] {
+		return packFailed
+	}
+
+	return packWritten
+}
+
+// Save stores the encrypted chunk data and sets the location of chunk. Chunks
+// that are added to a pack are only written with the pack, so an error is
+// only returned if the pack that contains chunk was written and failed.
+func (store *ChunkStore) Save(chunk *models.Chunk, ciphertext []byte) error {
+	if store.Packing != nil && chunk.Size <= store.Packing.MaxChunkSize {
+		store.packLock.Lock()
+		defer store.packLock.Unlock()
+
+		return store.savePacked(chunk, ciphertext)
+	}
+
+	err := saveChunk(store.OutputDir, chunk.Name+EncSuffix, ciphertext, store.getRetries())
+
+	if err != nil {
+		return err
+	}
+
+	store.addLocation(*chunk, uint64(len(ciphertext)))
+
+	return nil
+}
+
+func (store *ChunkStore) addLocation(chunk models.Chunk, size uint64) {
+	store.lock.Lock()
+	store.locations[chunk.Name] = chunk
+	store.lock.Unlock()
+
+	atomic.AddUint64(&store.SavedChunks, 1)
+	atomic.AddUint64(&store.SavedData, size)
+}
+
+// discardPack forgets the chunks in pack, which could not be written, so that
+// they are saved again if another file contains them.
+func (store *ChunkStore) discardPack(pack *pendingPack) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.failedPacks[pack.id] = true
+
+	for _, name := range pack.chunks {
+		delete(store.locations, name)
+	}
+
+	atomic.AddUint64(&store.SavedChunks, ^uint64(len(pack.chunks)-1))
+	atomic.AddUint64(&store.SavedData, ^uint64(pack.data.Len()-1))
+}
+
+func (store *ChunkStore) flush() error {
+	if store.pack == nil || store.pack.data.Len() == 0 {
+		return nil
+	}
+
+	pack := store.pack
+
+	utils.Trace.Printf("writing pack %s (%s)", pack.id, utils.FormatFileSize(uint64(pack.data.Len())))
+	err := savePack(store.OutputDir, pack.id, pack.data.Bytes(), store.getRetries())
+
+	if err != nil {
+		store.discardPack(pack)
+		err = fmt.Errorf("cannot write pack %s: %s", pack.id, err)
+	}
+
+	store.pack = nil
+
+	return err
+}
+
+func (store *ChunkStore) savePacked(chunk *models.Chunk, ciphertext []byte) error {
+	if store.pack == nil {
+		store.pack = &pendingPack{
+			id: utils.GetRandomID(),
+		}
+	}
+
+	chunk.Pack = store.pack.id
+	chunk.Offset = uint64(store.pack.data.Len())
+	chunk.Length = uint64(len(ciphertext))
+
+	store.pack.data.Write(ciphertext)
+	store.pack.chunks = append(store.pack.chunks, chunk.Name)
+	store.addLocation(*chunk, uint64(len(ciphertext)))
+
+	if packingSize(store.Packing) <= uint64(store.pack.data.Len()) {
+		return store.flush()
+	}
+
+	return nil
+}
+
+// applyCompressionFlags stores the compression algorithm from the command line
+// in doc. If it was not specified, the algorithm stored in the index is used.
+func applyCompressionFlags(doc *models.Document) {
+	if *archiveCompression == compressionNone {
+		doc.Compression = ""
+	} else if len(*archiveCompression) != 0 {
+		doc.Compression = *archiveCompression
+	}
+
+	if len(doc.Compression) != 0 {
+		utils.Info.Printf("compressing chunks with %s", doc.Compression)
+	}
+}
+
+// applyEncryptionFlags stores the chunk encryption mode from the command line
+// in doc. If it was not specified, the mode stored in the index is used.
+func applyEncryptionFlags(doc *models.Document) {
+	if *archiveEncryption == models.EncryptionOpenPGP {
+		doc.Encryption = ""
+	} else if len(*archiveEncryption) != 0 {
+		doc.Encryption = *archiveEncryption
+	}
+
+	if len(doc.Encryption) != 0 {
+		utils.Info.Printf("encrypting chunks with %s", doc.Encryption)
+	}
+}
+
+// applyPackingFlags stores the packing configuration from the command line in
+// doc. Settings that were not specified are taken from the index.
+func applyPackingFlags(doc *models.Document) {
+	doc.Packing = getPacking(doc.Packing, *archivePackSize, uint64(*archivePackChunkMax))
+
+	if doc.Packing != nil {
+		utils.Info.Printf("packing chunks up to %s into packs of %s",
+			utils.FormatFileSize(doc.Packing.MaxChunkSize), utils.FormatFileSize(doc.Packing.Size))
+	}
+}
+
+// getPacking applies the --pack-size and --pack-chunk-max values packSize and
+// packChunkMax to packing and returns the result. Empty or zero values keep
+// the setting of packing.
+func getPacking(packing *models.Packing, packSize string, packChunkMax uint64) *models.Packing {
+	if len(packSize) != 0 {
+		size, err := utils.ParseFileSize(packSize)
+
+		utils.PanicIfErr(err)
+
+		if size == 0 {
+			packing = nil
+		} else if size < minPackSize {
+			utils.PanicIfErr(fmt.Errorf("pack size must be at least %s", utils.FormatFileSize(minPackSize)))
+		} else {
+			if packing == nil {
+				packing = &models.Packing{
+					MaxChunkSize: defaultPackChunkMaxSize,
+				}
+			}
+
+			packing.Size = size
+		}
+	}
+
+	if packChunkMax != 0 && packing != nil {
+		packing.MaxChunkSize = packChunkMax
+	}
+
+	return packing
+}
+
+// compressChunk compresses data with algorithm. If the compressed data is not
+// smaller, the data is returned uncompressed and the returned algorithm is
+// empty.
+func compressChunk(data []byte, algorithm string) ([]byte, string) {
+	var compressed []byte
+
+	switch algorithm {
+	case models.CompressionGzip:
+		compressed = utils.CompressData(data)
+	case models.CompressionZstd:
+		compressed = utils.CompressDataZstd(data)
+	default:
+		return data, ""
+	}
+
+	if len(compressed) >= len(data) {
+		return data, ""
+	}
+
+	return compressed, algorithm
+}
+
+// decryptChunk decrypts and decompresses the encrypted data of chunk. The
+// decryption functions panic on errors, these panics are returned as errors.
+func decryptChunk(ciphertext []byte, chunk models.Chunk, key string) ([]byte, error) {
+	var data []byte
+	var err error
+
+	if chunk.Encryption == models.EncryptionHKDF {
+		data, err = utils.DecryptDataWithDerivedKey(ciphertext, key)
+	} else {
+		data, err = utils.DecryptData(ciphertext, key)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt chunk %s: %s", chunk.Name, err)
+	}
+
+	switch chunk.Compression {
+	case models.CompressionGzip:
+		data, err = utils.UncompressData(data)
+	case models.CompressionZstd:
+		data, err = utils.UncompressDataZstd(data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot uncompress chunk %s: %s", chunk.Name, err)
+	}
+
+	return data, nil
+}
+
+// encryptChunk encrypts data with the chunk encryption mode (empty for
+// OpenPGP).
+func encryptChunk(data []byte, mode string, key string) []byte {
+	if mode == models.EncryptionHKDF {
+		return utils.EncryptDataWithDerivedKey(data, key)
+	}
+
+	return utils.EncryptData(data, key)
+}
+
+// getChunkLocation returns where chunk is stored: the name of its own file or
+// the pack file with the offset and length of the chunk. Unlike the names of
+// chunks in pack files, locations can be seen by anyone with access to the
+// archive, so they may be stored unencrypted.
+func getChunkLocation(chunk models.Chunk) string {
+	if len(chunk.Pack) == 0 {
+		return getChunkFilename(chunk.Name)
+	}
+
+	return fmt.Sprintf("%s:%d+%d", getPackFilename(chunk.Pack), chunk.Offset, chunk.Length)
+}
+
+// getStoredFilename returns the name of the file that holds chunk: either its
+// own file or the pack file it is stored in.
+func getStoredFilename(chunk models.Chunk) string {
+	if len(chunk.Pack) != 0 {
+		return getPackFilename(chunk.Pack)
+	}
+
+	return getChunkFilename(chunk.Name)
+}
+
+// getChunkFilename returns the name of the file of a chunk in the archive.
+func getChunkFilename(chunkName string) string {
+	return path.Join(chunkName[:2], chunkName[:4], chunkName+EncSuffix)
+}
+
+// getPackFilename returns the name of a pack file in the archive.
+func getPackFilename(packID string) string {
+	return path.Join(packDirectory, packID[:2], packID+EncSuffix)
+}
+
+// getChunkPath returns the local path of the file of a chunk in the archive
+// directory.
+func getChunkPath(directory string, chunkName string) string {
+	return filepath.Join(directory, filepath.FromSlash(getChunkFilename(chunkName)))
+}
+
+// getPackPath returns the local path of a pack file in the archive
+// directory.
+func getPackPath(directory string, packID string) string {
+	return filepath.Join(directory, filepath.FromSlash(getPackFilename(packID)))
+}
+
+func packingSize(packing *models.Packing) uint64 {
+	if packing == nil {
+		return minPackSize
+	}
+
+	return packing.Size
+}
+
+// readChunk returns the encrypted data of chunk.
+func readChunk(inputDir string, chunk models.Chunk) ([]byte, error) {
+	if len(chunk.Pack) == 0 {
+		return getBackend(inputDir).Get(getChunkFilename(chunk.Name))
+	}
+
+	data, err := getBackend(inputDir).GetRange(getPackFilename(chunk.Pack), chunk.Offset, chunk.Length)
+
+	if err == backend.ErrTruncated {
+		return nil, fmt.Errorf("pack %s is truncated, chunk %s is missing", chunk.Pack, chunk.Name)
+	}
+
+	return data, err
+}
+
+func saveChunk(outputDir string, filename string, data []byte, retries int) error {
+	if *dryRun {
+		return nil
+	}
+
+	return putWithRetries(outputDir, path.Join(filename[0:2], filename[0:4], filename), data, retries)
+}
+
+func savePack(outputDir string, packID string, data []byte, retries int) error {
+	if *dryRun {
+		return nil
+	}
+
+	return putWithRetries(outputDir, getPackFilename(packID), data, retries)
+}
+
+// setChunkLocation copies everything that describes how and where a chunk is
+// stored from location to chunk.
+func setChunkLocation(chunk *models.Chunk, location models.Chunk) {
+	chunk.Pack = location.Pack
+	chunk.Offset = location.Offset
+	chunk.Length = location.Length
+	chunk.Compression = location.Compression
+	chunk.Encryption = location.Encryption
+	chunk.CiphertextHash = location.CiphertextHash
+}
+
+// scanChunkFiles returns all chunk and pack files in the archive in directory
+// by chunk name or pack ID. Paths are relative to the archive and use
+// slashes.
+func scanChunkFiles(directory string) map[string]ChunkFile {
+	chunkFiles := map[string]ChunkFile{}
+
+	err := getBackend(directory).List("", func(file backend.FileInfo) error {
+		filename := path.Base(file.Name)
+
+		if !strings.HasSuffix(filename, EncSuffix) || strings.HasPrefix(filename, databaseFilename) {
+			return nil
+		}
+
+		chunkFiles[filename[:len(filename)-len(EncSuffix)]] = ChunkFile{
+			Path: file.Name,
+			Size: file.Size,
+		}
+
+		return nil
+	})
+
+	utils.PanicIfErr(err)
+
+	return chunkFiles
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/srhnsn/securefilearchiver/models"
+	"github.com/srhnsn/securefilearchiver/utils"
+)
+
+const displayTimeFormat = "2006-01-02 15:04:05"
+
+// getIndexPath converts a path given on the command line to the form used as
+// key in the index.
+func getIndexPath(input string) string {
+	input = path.Clean(utils.FixSlashes(input))
+	input = strings.TrimPrefix(input, "/")
+
+	if input == "." {
+		return ""
+	}
+
+	return input
+}
+
+// getVersion returns version version of shortPath. version is either a
+// version number or the time at which the version was added, as shown by the
+// versions command. Version numbers start at 1 for the oldest stored version
+// and change when old versions are pruned; the times do not. An empty version
+// selects the newest version.
+func getVersion(doc *models.Document, shortPath string, version string) (models.File, error) {
+	versions := doc.GetFileVersions(shortPath)
+
+	if len(versions) == 0 {
+		return models.File{}, fmt.Errorf("%s is not in the archive", shortPath)
+	}
+
+	if len(version) == 0 {
+		return versions[len(versions)-1], nil
+	}
+
+	number, err := strconv.Atoi(version)
+
+	if err != nil {
+		return getVersionByTime(versions, shortPath, version)
+	}
+
+	if number < 1 || number > len(versions) {
+		return models.File{}, fmt.Errorf("%s has no version %d, there are %d versions (see the versions command)", shortPath, number, len(versions))
+	}
+
+	return versions[number-1], nil
+}
+
+// getVersionByTime returns the version in versions that was added at added,
+// which is formatted like in the output of the versions command.
+func getVersionByTime(versions []models.File, shortPath string, added string) (models.File, error) {
+	var found []models.File
+
+	for i, file := range versions {
+		if models.GetVersionStart(versions, i).Local().Format(displayTimeFormat) == added {
+			found = append(found, file)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return models.File{}, fmt.Errorf("%s has no version that was added at %s (see the versions command)", shortPath, added)
+	case 1:
+		return found[0], nil
+	}
+
+	return models.File{}, fmt.Errorf("%s has %d versions that were added at %s, use the version number", shortPath, len(found), added)
+}
+
+// listVersions prints all stored versions of shortPath in the archive in
+// inputDir.
+func listVersions(inputDir string, shortPath string) {
+	doc, err := readIndex(inputDir)
+
+	utils.PanicIfErr(err)
+
+	shortPath = getIndexPath(shortPath)
+	versions := doc.GetFileVersions(shortPath)
+
+	if len(versions) == 0 {
+		utils.PanicIfErr(fmt.Errorf("%s is not in the archive", shortPath))
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(writer, "Version\tSize\tModified\tAdded\tDeleted\t")
+
+	for i, file := range versions {
+		size := utils.FormatFileSize(file.Size)
+		deleted := "current"
+
+		if file.IsDirectory {
+			size = "directory"
+		}
+
+		if file.DeletedAt != nil {
+			deleted = file.DeletedAt.Local().Format(displayTimeFormat)
+		}
+
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t\n",
+			i+1,
+			size,
+			file.ModificationTime.Local().Format(displayTimeFormat),
+			models.GetVersionStart(versions, i).Local().Format(displayTimeFormat),
+			deleted,
+		)
+	}
+
+	err = writer.Flush()
+
+	utils.PanicIfErr(err)
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"io"
+)
+
+const (
+	gearSeed = 0x5346414348554e4b
+)
+
+var (
+	gearTable = newGearTable()
+)
+
+// Chunker splits a stream of data into chunks.
+type Chunker interface {
+	// Next returns the next chunk. It returns io.EOF if there is no more data.
+	Next() ([]byte, error)
+}
+
+type fixedChunker struct {
+	reader io.Reader
+	size   uint64
+}
+
+type contentDefinedChunker struct {
+	reader  io.Reader
+	buffer  []byte
+	start   int
+	end     int
+	eof     bool
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64
+	maskL   uint64
+}
+
+// NewFixedChunker returns a Chunker that cuts the data from reader into chunks
+// of exactly size bytes. Only the last chunk may be smaller.
+func NewFixedChunker(reader io.Reader, size uint64) Chunker {
+	return &fixedChunker{
+		reader: reader,
+		size:   size,
+	}
+}
+
+// NewContentDefinedChunker returns a Chunker that cuts the data from reader
+// where a rolling gear hash (as used by FastCDC) matches a mask. Chunk
+// boundaries only depend on the surrounding content, so inserting or removing
+// data only affects the chunks around the change.
+func NewContentDefinedChunker(reader io.Reader, minSize uint64, avgSize uint64, maxSize uint64) Chunker {
+	bits := log2(avgSize)
+
+	return &contentDefinedChunker{
+		reader:  reader,
+		buffer:  make([]byte, maxSize),
+		minSize: int(minSize),
+		avgSize: int(avgSize),
+		maxSize: int(maxSize),
+		maskS:   getGearMask(bits + 1),
+		maskL:   getGearMask(bits - 1),
+	}
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	data := make([]byte, c.size)
+
+	n, err := io.ReadFull(c.reader, data)
+
+	if err == io.ErrUnexpectedEOF {
+		return data[:n], nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *contentDefinedChunker) Next() ([]byte, error) {
+	if c.end-c.start < c.maxSize && !c.eof {
+		err := c.fill()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.end == c.start {
+		return nil, io.EOF
+	}
+
+	length := c.getCutPoint(c.buffer[c.start:c.end])
+
+	data := make([]byte, length)
+	copy(data, c.buffer[c.start:c.start+length])
+	c.start += length
+
+	return data, nil
+}
+
+func (c *contentDefinedChunker) fill() error {
+	c.end = copy(c.buffer, c.buffer[c.start:c.end])
+	c.start = 0
+
+	n, err := io.ReadFull(c.reader, c.buffer[c.end:])
+	c.end += n
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+
+	return err
+}
+
+// getCutPoint returns the length of the next chunk in data. It uses normalized
+// chunking: before avgSize a stricter mask is used, after it a looser one.
+func (c *contentDefinedChunker) getCutPoint(data []byte) int {
+	length := len(data)
+
+	if length <= c.minSize {
+		return length
+	}
+
+	if length > c.maxSize {
+		length = c.maxSize
+	}
+
+	normalSize := c.avgSize
+
+	if length < normalSize {
+		normalSize = length
+	}
+
+	var hash uint64
+	i := c.minSize
+
+	for ; i < normalSize; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < length; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return length
+}
+
+// getGearMask returns a mask with the highest bits bits set. The high bits of
+// the gear hash depend on the last 64 bytes, the low bits only on the last few.
+func getGearMask(bits uint) uint64 {
+	if bits == 0 {
+		return 0
+	}
+
+	return ^uint64(0) << (64 - bits)
+}
+
+func log2(value uint64) uint {
+	var bits uint
+
+	for value > 1 {
+		value >>= 1
+		bits++
+	}
+
+	return bits
+}
+
+// newGearTable returns 256 pseudo-random values generated with SplitMix64 from
+// a fixed seed. The values must never change, or else all chunk boundaries
+// (and thereby deduplication with existing archives) change.
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	state := uint64(gearSeed)
+
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}
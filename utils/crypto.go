@@ -2,31 +2,55 @@ package utils
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
 const (
-	gnupgBinary = "gpg2"
+	chunkNameKeyInfo  = "sfa chunk names"
+	derivedKeyInfo    = "sfa chunk encryption"
+	derivedKeySaltLen = 32
+	derivedKeyVersion = 1
 )
 
 var (
 	encryptionConfig = &packet.Config{
 		DefaultCipher: packet.CipherAES256,
 	}
+
+	// Without IsBinary, the data is marked as text and GnuPG converts line
+	// endings when decrypting it.
+	encryptionHints = &openpgp.FileHints{
+		IsBinary: true,
+	}
 )
 
+// DeriveChunkNameKey returns the secret that is used to compute keyed chunk
+// names with GetKeyedHashSum. It is derived from password with HKDF.
+func DeriveChunkNameKey(password string) []byte {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(password), nil, []byte(chunkNameKeyInfo)), key)
+
+	PanicIfErr(err)
+
+	return key
+}
+
 // DecryptData decrypts data using OpenPGP decryption.
-func DecryptData(input []byte, password string) []byte {
+func DecryptData(input []byte, password string) ([]byte, error) {
 	inputReader := bytes.NewReader(input)
 
 	tried := false
@@ -40,26 +64,40 @@ func DecryptData(input []byte, password string) []byte {
 		return []byte(password), nil
 	}, nil)
 
-	PanicIfErr(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
 
-	output, err := ioutil.ReadAll(md.UnverifiedBody)
+// DecryptDataWithDerivedKey decrypts data that was encrypted with
+// EncryptDataWithDerivedKey.
+func DecryptDataWithDerivedKey(input []byte, password string) ([]byte, error) {
+	if len(input) < 1+derivedKeySaltLen || input[0] != derivedKeyVersion {
+		return nil, errors.New("invalid data encrypted with derived key")
+	}
 
-	PanicIfErr(err)
+	salt := input[1 : 1+derivedKeySaltLen]
+	aead := newDerivedKeyAEAD(password, salt)
 
-	return output
+	return aead.Open(nil, make([]byte, aead.NonceSize()), input[1+derivedKeySaltLen:], nil)
 }
 
 // DecryptDataArmored decrypts armored data using OpenPGP decryption.
-func DecryptDataArmored(input []byte, password string) []byte {
+func DecryptDataArmored(input []byte, password string) ([]byte, error) {
 	inputReader := bytes.NewReader(input)
 	block, err := armor.Decode(inputReader)
 
-	PanicIfErr(err)
+	if err != nil {
+		return nil, err
+	}
 
-	armorReader := block.Body
-	unarmoredInput, err := ioutil.ReadAll(armorReader)
+	unarmoredInput, err := ioutil.ReadAll(block.Body)
 
-	PanicIfErr(err)
+	if err != nil {
+		return nil, err
+	}
 
 	return DecryptData(unarmoredInput, password)
 }
@@ -68,7 +106,7 @@ func DecryptDataArmored(input []byte, password string) []byte {
 func EncryptData(input []byte, password string) []byte {
 	var output bytes.Buffer
 
-	cryptoWriter, err := openpgp.SymmetricallyEncrypt(&output, []byte(password), nil, encryptionConfig)
+	cryptoWriter, err := openpgp.SymmetricallyEncrypt(&output, []byte(password), encryptionHints, encryptionConfig)
 	PanicIfErr(err)
 
 	_, err = cryptoWriter.Write(input)
@@ -80,6 +118,27 @@ func EncryptData(input []byte, password string) []byte {
 	return output.Bytes()
 }
 
+// EncryptDataWithDerivedKey encrypts data with AES-256-GCM. Unlike
+// EncryptData, password is not hashed with an expensive S2K function. Instead,
+// a key is derived from password and a random salt with HKDF-SHA256, so
+// password must already be a strong key. The output consists of a version
+// byte, the salt and the ciphertext.
+func EncryptDataWithDerivedKey(input []byte, password string) []byte {
+	salt := make([]byte, derivedKeySaltLen)
+	_, err := io.ReadFull(rand.Reader, salt)
+
+	PanicIfErr(err)
+
+	aead := newDerivedKeyAEAD(password, salt)
+
+	output := make([]byte, 0, 1+len(salt)+len(input)+aead.Overhead())
+	output = append(output, derivedKeyVersion)
+	output = append(output, salt...)
+
+	// Every key is only used once, so a constant nonce is safe.
+	return aead.Seal(output, make([]byte, aead.NonceSize()), input, nil)
+}
+
 // EncryptDataArmored encrypts data using symmetric OpenPGP encryption.
 // The result will be armored OpenPGP output.
 func EncryptDataArmored(input []byte, password string) []byte {
@@ -98,17 +157,6 @@ func EncryptDataArmored(input []byte, password string) []byte {
 	return output.Bytes()
 }
 
-// GetDecryptCommand returns a Windows console command to decrypt a specific
-// file that was encrypted with OpenPGP.
-func GetDecryptCommand(inputFile string, outputFile string, passwordFile string) string {
-	return fmt.Sprintf(`call %s --batch --decrypt --passphrase-file "%s" --quiet --output "%s" "%s"`,
-		gnupgBinary,
-		passwordFile,
-		outputFile,
-		inputFile,
-	)
-}
-
 // GetHashSum returns the hash sum for data using the preferred algorithm
 // (currently SHA-256).
 func GetHashSum(data []byte) string {
@@ -116,11 +164,60 @@ func GetHashSum(data []byte) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// GetHashSumReader returns the hash sum of everything that can be read from
+// reader, using the same algorithm as GetHashSum.
+func GetHashSumReader(reader io.Reader) (string, error) {
+	hash := NewHash()
+	_, err := io.Copy(hash, reader)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// GetKeyedHashSum returns the HMAC-SHA256 of data with key. Unlike GetHashSum,
+// it cannot be computed without knowing the key.
+func GetKeyedHashSum(data []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // GetNewDocumentKey returns 32 random bytes, encoded as a 64 byte hex string.
 func GetNewDocumentKey() string {
 	return getRandomHexBytes(32)
 }
 
+// GetRandomID returns 32 random bytes, encoded as a 64 byte hex string.
+func GetRandomID() string {
+	return getRandomHexBytes(32)
+}
+
+// NewHash returns a new hash for the algorithm that is used by GetHashSum.
+func NewHash() hash.Hash {
+	return sha256.New()
+}
+
+func newDerivedKeyAEAD(password string, salt []byte) cipher.AEAD {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(password), salt, []byte(derivedKeyInfo)), key)
+
+	PanicIfErr(err)
+
+	block, err := aes.NewCipher(key)
+
+	PanicIfErr(err)
+
+	aead, err := cipher.NewGCM(block)
+
+	PanicIfErr(err)
+
+	return aead
+}
+
 func getRandomHexBytes(length int) string {
 	data := make([]byte, length)
 	_, err := io.ReadFull(rand.Reader, data)
@@ -16,8 +16,17 @@ const (
 )
 
 var (
+	fileSizePattern   = regexp.MustCompile("^(\\d+)\\s*([KMGT]?)I?B?$")
 	humanRangePattern = regexp.MustCompile("(\\d+)([sihdwmy])")
 
+	fileSizeUnits = map[string]uint64{
+		"":  1,
+		"K": 1024,
+		"M": 1024 * 1024,
+		"G": 1024 * 1024 * 1024,
+		"T": 1024 * 1024 * 1024 * 1024,
+	}
+
 	humanRangeTokens = map[string]time.Duration{
 		"s": time.Second,
 		"i": time.Minute,
@@ -27,6 +36,13 @@ var (
 		"m": time.Hour * 24 * 30,
 		"y": time.Hour * 24 * 365,
 	}
+
+	pointInTimeLayouts = []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+		time.RFC3339,
+	}
 )
 
 // FileExists checks if a specified path (file or directory) exists.
@@ -68,14 +84,41 @@ func MustWriteFile(filename string, data []byte) {
 	PanicIfErr(err)
 }
 
-// MustWriteFileAtomic first writes the data to a temporary file, then renames it.
-func MustWriteFileAtomic(filename string, data []byte) {
-	tmpFilename := filename + TmpSuffix
+// ParseFileSize parses file sizes like "512", "64KiB" or "4MB" (base 2).
+func ParseFileSize(input string) (uint64, error) {
+	match := fileSizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(input)))
 
-	MustWriteFile(tmpFilename, data)
-	err := os.Rename(tmpFilename, filename)
+	if match == nil {
+		return 0, fmt.Errorf("invalid file size: %s", input)
+	}
 
-	PanicIfErr(err)
+	amount, err := strconv.ParseUint(match[1], 10, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return amount * fileSizeUnits[match[2]], nil
+}
+
+// ParsePointInTime parses a local date and time such as "2026-09-01 12:00" or
+// a human time range such as "2w", which means that long ago.
+func ParsePointInTime(input string) (time.Time, error) {
+	for _, layout := range pointInTimeLayouts {
+		t, err := time.ParseInLocation(layout, input, time.Local)
+
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	duration, err := ParseHumanRange(input)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid point in time: %s", input)
+	}
+
+	return time.Now().Add(-duration), nil
 }
 
 // PanicIfErr panics if the argument is not nil.
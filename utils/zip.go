@@ -4,6 +4,15 @@ import (
 	"bytes"
 	"compress/gzip"
 	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	zstdDecoder *zstd.Decoder
+	zstdEncoder *zstd.Encoder
+	zstdInit    sync.Once
 )
 
 // CompressData compresses bytes with the gzip algorithm.
@@ -22,18 +31,55 @@ func CompressData(data []byte) []byte {
 	return output.Bytes()
 }
 
+// CompressDataZstd compresses bytes with the Zstandard algorithm.
+func CompressDataZstd(data []byte) []byte {
+	initZstd()
+
+	return zstdEncoder.EncodeAll(data, nil)
+}
+
 // UncompressData uncompresses bytes with the gzip algorithm.
-func UncompressData(data []byte) []byte {
+func UncompressData(data []byte) ([]byte, error) {
 	inputRaw := bytes.NewBuffer(data)
 
 	inputZip, err := gzip.NewReader(inputRaw)
-	PanicIfErr(err)
+
+	if err != nil {
+		return nil, err
+	}
 
 	output, err := ioutil.ReadAll(inputZip)
-	PanicIfErr(err)
+
+	if err != nil {
+		return nil, err
+	}
 
 	err = inputZip.Close()
-	PanicIfErr(err)
 
-	return output
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// UncompressDataZstd uncompresses bytes with the Zstandard algorithm.
+func UncompressDataZstd(data []byte) ([]byte, error) {
+	initZstd()
+
+	return zstdDecoder.DecodeAll(data, nil)
+}
+
+// initZstd creates the shared Zstandard encoder and decoder. Both are safe for
+// concurrent use with EncodeAll and DecodeAll.
+func initZstd() {
+	zstdInit.Do(func() {
+		var err error
+
+		zstdEncoder, err = zstd.NewWriter(nil)
+		PanicIfErr(err)
+
+		zstdDecoder, err = zstd.NewReader(nil)
+		PanicIfErr(err)
+	})
 }